@@ -1,10 +1,15 @@
 package main
 
 import (
+	"os"
 	"outputGuard/control"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "uninstall" {
+		control.Uninstall(os.Args[2:])
+		return
+	}
 	client := control.NewControlClient()
 	go client.Exporter()
 	go client.RecvierServerMessage()
@@ -7,11 +7,16 @@ package main
  */
 import (
 	"fmt"
+	"os"
 	"outputGuard/control"
 	. "outputGuard/logger"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "plan" {
+		control.Plan(os.Args[2:])
+		return
+	}
 	client := control.NewControlRouter()
 	if err := client.BuildRouter(); err != nil {
 		Logger.Panic(fmt.Sprintf("路由添加失败:%s", err.Error()))
@@ -0,0 +1,62 @@
+package control
+
+import (
+	"fmt"
+	"time"
+
+	. "outputGuard/logger"
+	"outputGuard/pkg"
+	"outputGuard/service"
+)
+
+// 超过该时间没有连接的源地址/白名单地址组合不再暴露,避免指标无限增长
+const sourceIdleTTL = time.Hour
+
+type sourceSeries struct {
+	labels   []string
+	lastSeen time.Time
+}
+
+/*
+ * accountSources 定期从conntrack采集按源地址的流量,累加到exporter的计数器
+ * 未找到conntrack命令时不统计
+ */
+func (cc *Client) accountSources() {
+	if cc.sourceInterval <= 0 {
+		return
+	}
+	accounting, err := service.NewConntrackAccounting(cc.Ipt.IPv6())
+	if err != nil {
+		Logger.Warn(fmt.Sprintf("不按源地址统计流量:%s", err.Error()))
+		return
+	}
+	if err := cc.Css.CheckConntrackAccounting(); err != nil {
+		Logger.Warn(fmt.Sprintf("按源地址统计的流量可能为0:%s", err.Error()))
+	}
+
+	series := make(map[string]*sourceSeries)
+	ticker := time.NewTicker(cc.sourceInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		traffic, err := accounting.Poll()
+		if err != nil {
+			Logger.Error(fmt.Sprintf("采集conntrack失败:%s", err.Error()))
+			continue
+		}
+		now := time.Now()
+		for _, t := range traffic {
+			labels := []string{cc.hostname, t.Source, cc.sourceNames.Name(t.Source), t.Ip, t.Direction}
+			pkg.SourcePackets.WithLabelValues(labels...).Add(t.Packets)
+			pkg.SourceBytes.WithLabelValues(labels...).Add(t.Bytes)
+			key := t.Source + "_" + t.Ip + "_" + t.Direction
+			series[key] = &sourceSeries{labels: labels, lastSeen: now}
+		}
+		for key, s := range series {
+			if now.Sub(s.lastSeen) > sourceIdleTTL {
+				pkg.SourcePackets.DeleteLabelValues(s.labels...)
+				pkg.SourceBytes.DeleteLabelValues(s.labels...)
+				delete(series, key)
+			}
+		}
+	}
+}
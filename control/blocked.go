@@ -0,0 +1,101 @@
+package control
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"outputGuard/global"
+	. "outputGuard/logger"
+	"outputGuard/pkg"
+	"outputGuard/service"
+)
+
+// 每次上报的被拦截连接上限,按次数保留最多的
+const maxBlockedReport = 500
+
+// blockedAggregator 汇总两次上报之间被拦截的连接
+type blockedAggregator struct {
+	mutex   sync.Mutex
+	pending map[string]*global.BlockedFlow
+	// 指标的label -> 最后一次被拦截的时间,超过sourceIdleTTL后不再暴露
+	series map[[3]string]time.Time
+}
+
+func newBlockedAggregator() *blockedAggregator {
+	return &blockedAggregator{
+		pending: make(map[string]*global.BlockedFlow),
+		series:  make(map[[3]string]time.Time),
+	}
+}
+
+func (ba *blockedAggregator) add(hostname string, flow global.BlockedFlow) {
+	ba.mutex.Lock()
+	defer ba.mutex.Unlock()
+	if existing, ok := ba.pending[flow.Key()]; ok {
+		existing.Count += flow.Count
+		existing.LastSeen = flow.LastSeen
+	} else {
+		ba.pending[flow.Key()] = &flow
+	}
+	labels := [3]string{flow.IP, flow.Protocol, strconv.Itoa(flow.Port)}
+	ba.series[labels] = flow.LastSeen
+	pkg.BlockedConnections.WithLabelValues(hostname, labels[0], labels[1], labels[2]).Add(float64(flow.Count))
+}
+
+// flush 取出待上报的连接,同时清理长时间没有被拦截的指标
+func (ba *blockedAggregator) flush(hostname string) []global.BlockedFlow {
+	ba.mutex.Lock()
+	defer ba.mutex.Unlock()
+	flows := make([]global.BlockedFlow, 0, len(ba.pending))
+	for _, flow := range ba.pending {
+		flows = append(flows, *flow)
+	}
+	ba.pending = make(map[string]*global.BlockedFlow)
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].Count > flows[j].Count
+	})
+	if len(flows) > maxBlockedReport {
+		flows = flows[:maxBlockedReport]
+	}
+	now := time.Now()
+	for labels, lastSeen := range ba.series {
+		if now.Sub(lastSeen) > sourceIdleTTL {
+			pkg.BlockedConnections.DeleteLabelValues(hostname, labels[0], labels[1], labels[2])
+			delete(ba.series, labels)
+		}
+	}
+	return flows
+}
+
+/*
+ * watchBlocked 读取drop前记录的内核日志,汇总后定期上报给server
+ * 无法读取/dev/kmsg时(如非特权容器)只记录日志,不影响其他功能
+ */
+func (cc *Client) watchBlocked() {
+	if cc.blockedInterval <= 0 {
+		return
+	}
+	aggregator := newBlockedAggregator()
+	go func() {
+		ticker := time.NewTicker(cc.blockedInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			flows := aggregator.flush(cc.hostname)
+			if len(flows) == 0 {
+				continue
+			}
+			select {
+			case global.ClientCacher.BlockedChan <- flows:
+			default:
+				Logger.Warn(fmt.Sprintf("上报队列已满,丢弃%d条被拦截的连接", len(flows)))
+			}
+		}
+	}()
+	err := service.WatchBlocked(func(flow global.BlockedFlow) {
+		aggregator.add(cc.hostname, flow)
+	})
+	Logger.Warn(fmt.Sprintf("无法读取被拦截连接的内核日志:%s", err.Error()))
+}
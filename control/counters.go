@@ -0,0 +1,48 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	. "outputGuard/logger"
+	"outputGuard/pkg"
+)
+
+// counterState 持久化的流量总量,gateway重启后指标继续单调递增
+type counterState struct {
+	SavedAt time.Time          `json:"saved_at"`
+	Totals  []pkg.CounterTotal `json:"totals"`
+}
+
+// restoreCounters 文件不存在或解析失败时从0开始累加
+func (cc *Client) restoreCounters() {
+	if cc.counterFile == "" {
+		return
+	}
+	data, err := os.ReadFile(cc.counterFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Logger.Error(fmt.Sprintf("读取流量总量失败,从0开始累加:%s", err.Error()))
+		}
+		return
+	}
+	var state counterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		Logger.Error(fmt.Sprintf("解析%s失败,从0开始累加:%s", cc.counterFile, err.Error()))
+		return
+	}
+	pkg.Counters.RestoreTotals(state.Totals)
+	Logger.Info(fmt.Sprintf("从%s恢复%d条流量总量,保存于%s", cc.counterFile, len(state.Totals), state.SavedAt.Format(time.RFC3339)))
+}
+
+func (cc *Client) saveCounters() {
+	if cc.counterFile == "" {
+		return
+	}
+	state := counterState{SavedAt: time.Now(), Totals: pkg.Counters.Totals()}
+	if err := writeJSON(cc.counterFile, state); err != nil {
+		Logger.Error(fmt.Sprintf("保存流量总量到%s失败:%s", cc.counterFile, err.Error()))
+	}
+}
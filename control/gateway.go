@@ -3,42 +3,105 @@ package control
 import (
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
 	"outputGuard/global"
 	. "outputGuard/logger"
 	"outputGuard/pkg"
 	"outputGuard/service"
+	"time"
 )
 
-func init() {
-	global.ExporterDatas <- global.ExporterData{
-		ChainName: "done",
+/*
+ * gateway的参数在创建时统一解析
+ * 防火墙后端需要在处理消息前确定
+ */
+func NewControlClient() *Client {
+	client := &Client{
+		wss:         service.NewWebSocketClient(),
+		retries:     make(map[string]*retry),
+		deadLetters: newDeadLetterList(),
 	}
-}
+	flag.StringVar(&client.wss.WssServerAddr, "iptables-wss-server", "", "设置server地址")
+	flag.StringVar(&client.wss.Token, "gateway-token", "", "设置注册到server使用的token")
+	useTLS := flag.Bool("wss-tls", false, "使用wss连接server")
+	caFile := flag.String("wss-ca-file", "", "校验server证书的CA,为空时使用系统CA")
+	certFile := flag.String("wss-cert-file", "", "gateway的客户端证书")
+	keyFile := flag.String("wss-key-file", "", "gateway的客户端证书私钥")
+	backend := flag.String("firewall-backend", service.BackendIptables, "防火墙后端:iptables/ipset/nftables")
+	flag.DurationVar(&client.driftInterval, "drift-interval", time.Minute, "检查并修复规则漂移的间隔,为0时不检查")
+	flag.StringVar(&client.stateFile, "state-file", defaultStateFile, "保存期望状态的文件,为空时不保存")
+	flag.BoolVar(&client.migrateLegacy, "migrate-legacy", false, "启动时删除旧版本直接写在内置链中的规则,只删除地址在期望状态与内网网段中的规则")
+	flag.DurationVar(&client.sourceInterval, "source-accounting-interval", 15*time.Second, "从conntrack按源地址统计流量的间隔,为0时不统计")
+	sourceNamesFile := flag.String("source-names", "", "源地址到名字的映射文件,用于按源地址统计的流量")
+	flag.DurationVar(&client.counterInterval, "counter-interval", 15*time.Second, "采集防火墙流量计数的间隔")
+	flag.StringVar(&client.counterFile, "counter-file", "/var/lib/outputguard/counters.json", "保存流量总量的文件,为空时不保存")
+	internalFile := flag.String("internal-networks-file", "", "内网网段文件,在默认内网网段之外追加")
+	flag.DurationVar(&client.blockedInterval, "blocked-report-interval", 30*time.Second, "上报被拦截连接的间隔,为0时不读取内核日志")
+	flag.Parse()
 
-func NewControlClient() *Client {
-	client := &Client{}
+	if client.wss.WssServerAddr == "" {
+		Logger.Panic("wss server 地址为空,使用 -iptables-wss-server指定")
+	}
+	if *useTLS || *caFile != "" || *certFile != "" {
+		tlsConf, err := global.ClientTLSConfig(*caFile, *certFile, *keyFile)
+		if err != nil {
+			Logger.Panic(fmt.Sprintf("加载TLS配置失败:%s", err.Error()))
+		}
+		client.wss.TLS = tlsConf
+	}
+	if err := loadInternalNetworks(*internalFile); err != nil {
+		Logger.Panic(fmt.Sprintf("加载内网网段失败:%s", err.Error()))
+	}
+	sourceNames, err := service.LoadSourceNames(*sourceNamesFile)
+	if err != nil {
+		Logger.Panic(fmt.Sprintf("加载源地址名字失败:%s", err.Error()))
+	}
+	client.sourceNames = sourceNames
 
-	ipt, err := service.NewIpts()
+	ipt, err := service.NewFirewall(*backend)
 	if err != nil {
-		Logger.Panic(fmt.Sprintf("初始化iptables失败:%s", err.Error()))
+		Logger.Panic(fmt.Sprintf("初始化%s失败:%s", *backend, err.Error()))
 	}
+	Logger.Info(fmt.Sprintf("使用%s后端", *backend))
 	client.Ipt = ipt
+	client.hostname, _ = os.Hostname()
 	return client
 }
 
 type Client struct {
-	Ipt service.IptableRules
+	Ipt service.Firewall
 	Css *service.ClientService
+	wss *service.WebSocketClient
+	// 最后一次应用的快照revision,之前的消息重试时直接丢弃
+	snapshotRevision uint64
+	// 最后一次从server收到的期望状态,收到快照前为nil
+	desired       map[string]global.Messages
+	driftInterval time.Duration
+	hostname      string
+	stateFile     string
+	// 从旧版本升级时删除旧版本写在内置链中的规则
+	migrateLegacy bool
+	// 等待重试的消息,key为消息的Key(),只在处理消息的goroutine中访问
+	retries     map[string]*retry
+	deadLetters *deadLetterList
+	// 按源地址统计流量的间隔与源地址的名字
+	sourceInterval time.Duration
+	sourceNames    *service.SourceNames
+	// 上报被拦截连接的间隔
+	blockedInterval time.Duration
+	// 采集流量计数的间隔与保存流量总量的文件
+	counterInterval time.Duration
+	counterFile     string
 }
 
 func (cc *Client) RecvierServerMessage() {
 
-	client := service.NewWebSocketClient()
+	client := cc.wss
 	defer client.Close()
-	flag.StringVar(&client.WssServerAddr, "iptables-wss-server", "", "设置server地址")
-	flag.Parse()
-	if client.WssServerAddr == "" {
-		Logger.Panic("wss server 地址为空,使用 -iptables-wss-server指定")
+	client.RuleCounter = func() (int, error) {
+		rules, err := cc.Ipt.Cache()
+		return len(rules), err
 	}
 	client.Connect()
 	client.StartReceiver()
@@ -51,98 +114,318 @@ func (cc *Client) HandleIptablesMessage() {
 	if err := cc.Css.CheckIPForwarding(); err != nil {
 		Logger.Panic(fmt.Sprintf("检查内核参数失败:%s", err.Error()))
 	}
+	if cc.Ipt.IPv6() {
+		if err := cc.Css.CheckIPv6Forwarding(); err != nil {
+			Logger.Warn(fmt.Sprintf("检查IPv6内核参数失败,IPv6流量无法转发:%s", err.Error()))
+		}
+	}
 
-	//添加允许内网网段，避免机器访问内网失败
-	if err := cc.Ipt.InitAddLocalNet(); err != nil {
-		Logger.Panic(fmt.Sprintf("初始化允许内网网段失败:%s", err.Error()))
-	}
-
-	// 添加forward accept规则
-	if err := cc.Ipt.CheckForwardAcceptRule(); err != nil {
-		Logger.Panic(fmt.Sprintf("添加forward accept规则失败! %s", err.Error()))
-	}
-
-	// 添加drop all规则
-	if err := cc.Ipt.AddDropAll(); err != nil {
-		Logger.Panic(fmt.Sprintf("添加drop all失败! %s", err.Error()))
-	}
-
-	iptSem := make(chan struct{}, 10)
-	for message := range global.ClientCacher.IpChan {
-		iptSem <- struct{}{}
-		go func(message global.Messages) {
-			defer func() {
-				<-iptSem
-			}()
-
-			switch message.Action {
-			case "add":
-				if err := cc.Ipt.AddAccept(message.IP); err != nil {
-					global.ClientCacher.IpChan <- message
-					Logger.Error(fmt.Sprintf("%s添加iptables规则失败:%s,写回通道继续重试", message.IP, err.Error()))
-					return
-				}
-				if !message.IsLocalNet {
-
-					if err := cc.Ipt.AddMasqueradeRule(message.IP); err != nil {
-						global.ClientCacher.IpChan <- message
-						Logger.Error(fmt.Sprintf("%s添加伪装规则失败:%s,写回通道继续重试", message.IP, err.Error()))
-						return
-					}
-					if err := cc.Ipt.AddForwordRule(message.IP); err != nil {
-						global.ClientCacher.IpChan <- message
-						Logger.Error(fmt.Sprintf("%s添加转发规则失败:%s,写回通道继续重试", message.IP, err.Error()))
-						return
-					}
-
-				}
-
-			case "del":
-
-				if err := cc.Ipt.DeleteAccept(message.IP); err != nil {
-					global.ClientCacher.IpChan <- message
-					Logger.Error(fmt.Sprintf("%s删除iptables规则失败:%s,写回通道继续重试", message.IP, err.Error()))
-					return
-				}
-				if !message.IsLocalNet {
-					if err := cc.Ipt.DeleteMasqueradeRule(message.IP); err != nil {
-						global.ClientCacher.IpChan <- message
-						Logger.Error(fmt.Sprintf("%s删除伪装规则失败:%s,写回通道继续重试", message.IP, err.Error()))
-						return
-					}
-					if err := cc.Ipt.DeleteForwordRule(message.IP); err != nil {
-						global.ClientCacher.IpChan <- message
-						Logger.Error(fmt.Sprintf("%s删除转发规则失败:%s,写回通道继续重试", message.IP, err.Error()))
-						return
-
-					}
-				}
-			default:
-				Logger.Info(fmt.Sprintf("%s的行为%s未知,不处理", message.IP, message.Action))
-				return
+	// 放行内网网段、转发与本地保存的规则,添加drop all
+	cc.restoreState()
+	if cc.migrateLegacy {
+		if err := migrateLegacy(cc.stateFile); err != nil {
+			Logger.Error(err.Error())
+		}
+	}
 
+	// 漂移检测、重试与消息处理在同一个goroutine中,修复与重试不会与增量消息交错
+	retryTicker := time.NewTicker(retryBase)
+	defer retryTicker.Stop()
+	var drift <-chan time.Time
+	if cc.driftInterval > 0 {
+		ticker := time.NewTicker(cc.driftInterval)
+		defer ticker.Stop()
+		drift = ticker.C
+	}
+	for {
+		select {
+		case message := <-global.ClientCacher.IpChan:
+			cc.handle(message)
+		case <-retryTicker.C:
+			cc.retryDue()
+		case <-drift:
+			cc.heal()
+		}
+	}
+}
+
+func (cc *Client) handle(message global.Messages) {
+	batch := cc.collect(message)
+	last := batch[len(batch)-1]
+	if last.Action == global.ActionSnapshot {
+		cc.applyBatch(batch[:len(batch)-1])
+		cc.reconcile(last)
+	} else {
+		cc.applyBatch(batch)
+	}
+	cc.saveState()
+	cc.publishEntryInfo()
+}
+
+// publishEntryInfo 按期望状态更新exporter中ip所属的条目
+func (cc *Client) publishEntryInfo() {
+	infos := make([]pkg.EntryInfo, 0, len(cc.desired))
+	seen := make(map[string]bool, len(cc.desired))
+	for _, m := range desiredItems(cc.desired) {
+		ip := global.ExporterAddr(m.IP)
+		for _, ref := range m.Entries {
+			key := fmt.Sprintf("%s_%d", ip, ref.ID)
+			if seen[key] {
+				continue
 			}
-			Logger.Info(fmt.Sprintf("ip:%s %siptables成功!", message.IP, message.Action))
-		}(message)
+			seen[key] = true
+			infos = append(infos, pkg.EntryInfo{Hostname: cc.hostname, IP: ip, EntryID: ref.ID, Name: ref.Name, Owner: ref.Owner})
+		}
 	}
+	pkg.EntryInfos.Update(infos)
 }
 
-func (cc *Client) Exporter() {
+/*
+ * restoreState 启动时先恢复本地保存的期望状态,再添加drop all
+ * 连接server后收到的快照会覆盖本地状态
+ */
+func (cc *Client) restoreState() {
+	var state *desiredState
+	if cc.stateFile != "" {
+		var err error
+		state, err = loadState(cc.stateFile)
+		if err != nil {
+			Logger.Error(fmt.Sprintf("读取本地期望状态失败,等待server下发快照:%s", err.Error()))
+		}
+	}
+	if state != nil {
+		if err := cc.Ipt.Init(state.Items); err != nil {
+			Logger.Error(fmt.Sprintf("按本地期望状态初始化防火墙失败,忽略本地状态:%s", err.Error()))
+			state = nil
+		}
+	}
+	if state == nil {
+		if err := cc.Ipt.Init(nil); err != nil {
+			Logger.Panic(fmt.Sprintf("初始化防火墙失败:%s", err.Error()))
+		}
+		return
+	}
+	// 删除本地状态中已不存在的规则
+	if _, removed, err := cc.Ipt.Reconcile(state.Items); err != nil {
+		Logger.Error(fmt.Sprintf("按本地期望状态对齐规则失败:%s", err.Error()))
+	} else if removed > 0 {
+		Logger.Info(fmt.Sprintf("按本地期望状态删除%d条规则", removed))
+	}
+	cc.desired = make(map[string]global.Messages, len(state.Items))
+	for _, m := range state.Items {
+		cc.desired[m.Key()] = m
+	}
+	cc.publishEntryInfo()
+	Logger.Info(fmt.Sprintf("从%s恢复%d条规则,保存于%s(revision %d)", cc.stateFile, len(state.Items), state.SavedAt.Format(time.RFC3339), state.Revision))
+}
+
+// saveState 期望状态变化后保存,收到快照前没有可保存的状态
+func (cc *Client) saveState() {
+	if cc.stateFile == "" || cc.desired == nil {
+		return
+	}
+	state := desiredState{
+		Revision: cc.snapshotRevision,
+		SavedAt:  time.Now(),
+		Items:    desiredItems(cc.desired),
+	}
+	if err := saveState(cc.stateFile, state); err != nil {
+		Logger.Error(fmt.Sprintf("保存期望状态到%s失败:%s", cc.stateFile, err.Error()))
+	}
+}
 
-	go func() {
-		for {
+// 增量消息攒批的时间窗口与最大条数
+const (
+	batchWindow = 200 * time.Millisecond
+	batchSize   = 1000
+)
 
-			<-global.RunSig
-			if err := cc.Ipt.Count("filter", "FORWARD"); err != nil {
-				Logger.Error(fmt.Sprintf("构建iptables exporter数据失败:%s", err.Error()))
+/*
+ * collect 从第一条消息开始,在时间窗口内收集一批消息
+ * 快照总是作为批次的最后一条,之前的增量消息先于快照应用
+ */
+func (cc *Client) collect(first global.Messages) []global.Messages {
+	batch := []global.Messages{first}
+	if first.Action == global.ActionSnapshot {
+		return batch
+	}
+	timer := time.NewTimer(batchWindow)
+	defer timer.Stop()
+	for len(batch) < batchSize {
+		select {
+		case message := <-global.ClientCacher.IpChan:
+			batch = append(batch, message)
+			if message.Action == global.ActionSnapshot {
+				return batch
+			}
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
 
+/*
+ * 一批消息一次性写入,成功后逐条ack
+ * 整批失败时逐条应用,找出失败的消息重试,避免一条错误的消息阻塞整批
+ */
+func (cc *Client) applyBatch(batch []global.Messages) {
+	valid := make([]global.Messages, 0, len(batch))
+	for _, message := range batch {
+		switch message.Action {
+		case global.ActionAdd:
+			valid = append(valid, message)
+			if cc.desired != nil {
+				// server每次下发引用该规则的所有条目,条目删除后也会重新下发,直接替换
+				cc.desired[message.Key()] = message
 			}
-			global.ExporterDatas <- global.ExporterData{
-				ChainName: "done",
+		case global.ActionDel:
+			valid = append(valid, message)
+			if cc.desired != nil {
+				delete(cc.desired, message.Key())
 			}
+		default:
+			Logger.Info(fmt.Sprintf("%s的行为%s未知,不处理", message.IP, message.Action))
+			global.ClientCacher.AckChan <- global.Ack{Revision: message.Revision, Error: "unknown action " + message.Action}
 		}
+	}
+	if len(valid) == 0 {
+		return
+	}
+	err := cc.Ipt.ApplyBatch(valid)
+	if err == nil {
+		for _, message := range valid {
+			cc.supersede(message)
+			cc.succeed(message)
+		}
+		Logger.Info(fmt.Sprintf("批量应用%d条规则成功", len(valid)))
+		return
+	}
+	if len(valid) > 1 {
+		Logger.Error(fmt.Sprintf("批量应用%d条规则失败:%s,改为逐条应用", len(valid), err.Error()))
+	}
+	// 按revision顺序逐条应用,同一地址的后续消息会作废之前失败的重试
+	// 批量写入可能已部分生效(ipset),Apply是幂等的,结果以逐条应用为准
+	for _, message := range valid {
+		cc.supersede(message)
+		if err := cc.Ipt.Apply(message); err != nil {
+			cc.fail(message, err)
+			continue
+		}
+		Logger.Info(fmt.Sprintf("ip:%s %siptables成功!", message.Key(), message.Action))
+		cc.succeed(message)
+	}
+}
+
+// reconcile 快照之前的增量消息已应用,对齐期间不处理新的消息
+func (cc *Client) reconcile(snapshot global.Messages) {
+	cc.snapshotRevision = snapshot.Revision
+	cc.dropRetries()
+	cc.desired = make(map[string]global.Messages, len(snapshot.Items))
+	for _, m := range snapshot.Items {
+		cc.desired[m.Key()] = m
+	}
+	added, removed, err := cc.Ipt.Reconcile(snapshot.Items)
+	if err != nil {
+		Logger.Error(fmt.Sprintf("按快照对齐iptables规则失败:%s,新增:%d,删除:%d", err.Error(), added, removed))
+		global.ClientCacher.AckChan <- global.Ack{Revision: snapshot.Revision, Snapshot: true, Error: err.Error()}
+		return
+	}
+	global.ClientCacher.AckChan <- global.Ack{Revision: snapshot.Revision, Snapshot: true}
+	pkg.DeadLetters.WithLabelValues(cc.hostname).Set(float64(cc.deadLetters.clear()))
+	Logger.Info(fmt.Sprintf("按快照对齐iptables规则完成,期望规则数:%d,新增:%d,删除:%d", len(snapshot.Items), added, removed))
+}
+
+/*
+ * heal 比较实际规则与最后一次收到的期望状态,发现漂移时修复
+ * 规则被清空、链或跳转规则被改动时先重新初始化,再按期望状态整体对齐
+ */
+func (cc *Client) heal() {
+	if cc.desired == nil {
+		return
+	}
+	desired := desiredItems(cc.desired)
+	drift, err := cc.Ipt.Verify(desired)
+	if err != nil {
+		pkg.DriftChecks.WithLabelValues(cc.hostname, "failed").Inc()
+		Logger.Error(fmt.Sprintf("检查规则漂移失败:%s", err.Error()))
+		return
+	}
+	if drift.Empty() {
+		pkg.DriftChecks.WithLabelValues(cc.hostname, "clean").Inc()
+		return
+	}
+	for _, m := range drift.Missing {
+		Logger.Warn(fmt.Sprintf("规则漂移:缺少%s,重新添加", m.Key()))
+	}
+	for _, m := range drift.Unexpected {
+		Logger.Warn(fmt.Sprintf("规则漂移:%s不在期望状态中,删除", m.Key()))
+	}
+	for _, desc := range drift.Structure {
+		Logger.Warn(fmt.Sprintf("规则漂移:%s,重新初始化", desc))
+	}
+	/*
+	 * 结构异常时按期望状态重新初始化,链与规则在同一次写入中恢复,不会出现只有drop的中间状态
+	 * ipset与nftables的Init只添加不删除,多余的规则仍需对齐删除
+	 */
+	if len(drift.Structure) > 0 {
+		if err := cc.Ipt.Init(desired); err != nil {
+			pkg.DriftChecks.WithLabelValues(cc.hostname, "failed").Inc()
+			Logger.Error(fmt.Sprintf("修复规则漂移时初始化防火墙失败:%s", err.Error()))
+			return
+		}
+	}
+	if len(drift.Structure) == 0 || len(drift.Unexpected) > 0 {
+		if _, _, err := cc.Ipt.Reconcile(desired); err != nil {
+			pkg.DriftChecks.WithLabelValues(cc.hostname, "failed").Inc()
+			Logger.Error(fmt.Sprintf("修复规则漂移失败:%s", err.Error()))
+			return
+		}
+	}
+	pkg.DriftChecks.WithLabelValues(cc.hostname, "repaired").Inc()
+	pkg.DriftCorrections.WithLabelValues(cc.hostname, "missing").Add(float64(len(drift.Missing)))
+	pkg.DriftCorrections.WithLabelValues(cc.hostname, "unexpected").Add(float64(len(drift.Unexpected)))
+	pkg.DriftCorrections.WithLabelValues(cc.hostname, "structure").Add(float64(len(drift.Structure)))
+	Logger.Info(fmt.Sprintf("规则漂移已修复,缺少:%d,多余:%d,结构异常:%d", len(drift.Missing), len(drift.Unexpected), len(drift.Structure)))
+}
+
+/*
+ * collectCounters 按-counter-interval采集流量计数,写入exporter的快照
+ * 采集失败时保留上一次的快照,outputguard_counters_age_seconds会持续增长
+ * 每次采集后保存累加的总量
+ */
+func (cc *Client) collectCounters() {
+	cc.restoreCounters()
+	interval := cc.counterInterval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		start := time.Now()
+		data, err := cc.Ipt.Count()
+		if err != nil {
+			pkg.CounterCollections.WithLabelValues("failed").Inc()
+			Logger.Error(fmt.Sprintf("构建iptables exporter数据失败:%s", err.Error()))
+		} else {
+			pkg.CounterCollections.WithLabelValues("success").Inc()
+		}
+		// iptables后端部分规则解析失败时仍然返回其余的计数
+		if data != nil {
+			pkg.Counters.Update(data, time.Since(start))
+			cc.saveCounters()
+		}
+	}
+}
+
+func (cc *Client) Exporter() {
+
+	go cc.accountSources()
+	go cc.watchBlocked()
 
-	}()
+	go cc.collectCounters()
 
+	http.HandleFunc("/api/v1/dead-letters", cc.ListDeadLetters)
 	pkg.RunExporter()
 }
@@ -0,0 +1,12 @@
+package control
+
+import "outputGuard/global"
+
+// loadInternalNetworks gateway与router共用,文件为空时只使用默认内网网段
+func loadInternalNetworks(path string) error {
+	extra, err := global.LoadInternalNetworks(path)
+	if err != nil {
+		return err
+	}
+	return global.SetInternalNetworks(extra)
+}
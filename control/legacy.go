@@ -0,0 +1,41 @@
+package control
+
+import (
+	"fmt"
+
+	"outputGuard/global"
+	. "outputGuard/logger"
+	"outputGuard/service"
+)
+
+/*
+ * migrateLegacy 从旧版本升级时删除旧版本直接写在内置链中的规则,只在指定-migrate-legacy时执行
+ * 只删除地址为本地保存的期望状态或内网网段的规则,其他程序与管理员添加的规则不受影响
+ */
+func migrateLegacy(stateFile string) error {
+	ipt, err := service.NewIpts()
+	if err != nil {
+		return err
+	}
+	addrs := make(map[string]bool)
+	for _, local := range append(global.InternalNetworks(false), global.InternalNetworks(true)...) {
+		addrs[global.CanonicalAddr(local)] = true
+	}
+	var state *desiredState
+	if stateFile != "" {
+		if state, err = loadState(stateFile); err != nil {
+			return err
+		}
+	}
+	if state == nil {
+		Logger.Warn("本地期望状态不存在,只删除旧版本的内网网段放行与drop规则")
+	} else {
+		for _, m := range state.Items {
+			addrs[global.CanonicalAddr(m.IP)] = true
+		}
+	}
+	if err := ipt.MigrateLegacy(addrs); err != nil {
+		return fmt.Errorf("删除旧版本的规则失败:%v", err)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"outputGuard/global"
+	. "outputGuard/logger"
+	"outputGuard/pkg"
+)
+
+/*
+ * 失败的消息按目的地址退避重试,同一地址的新消息到达时旧的重试作废
+ * 超过最大次数后放入死信列表,不再重试,由快照或新的消息覆盖
+ */
+const (
+	retryBase      = time.Second
+	retryMax       = time.Minute
+	maxAttempts    = 8
+	maxDeadLetters = 1000
+)
+
+type retry struct {
+	message  global.Messages
+	attempts int
+	next     time.Time
+	first    time.Time
+}
+
+// backoff 第n次失败后的等待时间
+func backoff(attempts int) time.Duration {
+	d := retryBase << (attempts - 1)
+	if d <= 0 || d > retryMax {
+		return retryMax
+	}
+	return d
+}
+
+type DeadLetter struct {
+	Key         string          `json:"key"`
+	Message     global.Messages `json:"message"`
+	Revision    uint64          `json:"revision"`
+	Attempts    int             `json:"attempts"`
+	Error       string          `json:"error"`
+	FirstFailed time.Time       `json:"first_failed"`
+	LastFailed  time.Time       `json:"last_failed"`
+}
+
+// deadLetterList 按规则的Key保存,HTTP接口在其他goroutine中读取
+type deadLetterList struct {
+	mutex sync.Mutex
+	items map[string]DeadLetter
+}
+
+func newDeadLetterList() *deadLetterList {
+	return &deadLetterList{items: make(map[string]DeadLetter)}
+}
+
+// add 超过上限时丢弃最早的
+func (dl *deadLetterList) add(d DeadLetter) int {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+	dl.items[d.Key] = d
+	if len(dl.items) > maxDeadLetters {
+		oldest := ""
+		for k, v := range dl.items {
+			if oldest == "" || v.LastFailed.Before(dl.items[oldest].LastFailed) {
+				oldest = k
+			}
+		}
+		delete(dl.items, oldest)
+	}
+	return len(dl.items)
+}
+
+// resolve 同一规则的新消息应用成功后移除
+func (dl *deadLetterList) resolve(key string) (int, bool) {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+	_, ok := dl.items[key]
+	delete(dl.items, key)
+	return len(dl.items), ok
+}
+
+// clear 快照应用成功后移除全部死信,死信的消息都早于快照收到,已由快照覆盖
+func (dl *deadLetterList) clear() int {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+	dl.items = make(map[string]DeadLetter)
+	return 0
+}
+
+func (dl *deadLetterList) list() []DeadLetter {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+	items := make([]DeadLetter, 0, len(dl.items))
+	for _, v := range dl.items {
+		items = append(items, v)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Revision < items[j].Revision
+	})
+	return items
+}
+
+/*
+ * supersede 同一地址的新消息到达时,作废之前的重试并ack,避免旧消息在新消息之后执行
+ * 消息按接收顺序处理,重试中的消息总是先收到;server重启后revision从0开始,不能比较大小
+ */
+func (cc *Client) supersede(message global.Messages) {
+	r, ok := cc.retries[message.Key()]
+	if !ok || r.message.Revision == message.Revision {
+		return
+	}
+	delete(cc.retries, message.Key())
+	Logger.Info(fmt.Sprintf("%s的revision %d已被revision %d覆盖,不再重试", message.Key(), r.message.Revision, message.Revision))
+	global.ClientCacher.AckChan <- global.Ack{Revision: r.message.Revision}
+}
+
+func (cc *Client) succeed(message global.Messages) {
+	if r, ok := cc.retries[message.Key()]; ok && r.message.Revision == message.Revision {
+		delete(cc.retries, message.Key())
+	}
+	if n, ok := cc.deadLetters.resolve(message.Key()); ok {
+		pkg.DeadLetters.WithLabelValues(cc.hostname).Set(float64(n))
+	}
+	global.ClientCacher.AckChan <- global.Ack{Revision: message.Revision}
+}
+
+// fail 安排退避重试并通知server,超过最大次数后放入死信列表
+func (cc *Client) fail(message global.Messages, err error) {
+	now := time.Now()
+	r, ok := cc.retries[message.Key()]
+	if !ok || r.message.Revision != message.Revision {
+		r = &retry{message: message, first: now}
+		cc.retries[message.Key()] = r
+	}
+	r.attempts++
+	if r.attempts >= maxAttempts {
+		delete(cc.retries, message.Key())
+		n := cc.deadLetters.add(DeadLetter{
+			Key:         message.Key(),
+			Message:     message,
+			Revision:    message.Revision,
+			Attempts:    r.attempts,
+			Error:       err.Error(),
+			FirstFailed: r.first,
+			LastFailed:  now,
+		})
+		pkg.DeadLetters.WithLabelValues(cc.hostname).Set(float64(n))
+		Logger.Error(fmt.Sprintf("%s %s失败%d次,放入死信列表:%s", message.Key(), message.Action, r.attempts, err.Error()))
+		global.ClientCacher.AckChan <- global.Ack{
+			Revision:   message.Revision,
+			Error:      err.Error(),
+			Key:        message.Key(),
+			Attempt:    r.attempts,
+			DeadLetter: true,
+		}
+		return
+	}
+	wait := backoff(r.attempts)
+	r.next = now.Add(wait)
+	pkg.ApplyRetries.WithLabelValues(cc.hostname).Inc()
+	Logger.Error(fmt.Sprintf("%s %s第%d次失败:%s,%s后重试", message.Key(), message.Action, r.attempts, err.Error(), wait))
+	global.ClientCacher.AckChan <- global.Ack{
+		Revision: message.Revision,
+		Error:    err.Error(),
+		Key:      message.Key(),
+		Attempt:  r.attempts,
+		Retrying: true,
+	}
+}
+
+// retryDue 到期的重试按revision顺序重新应用
+func (cc *Client) retryDue() {
+	now := time.Now()
+	due := make([]global.Messages, 0)
+	for _, r := range cc.retries {
+		if !r.next.After(now) {
+			due = append(due, r.message)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Revision < due[j].Revision
+	})
+	cc.applyBatch(due)
+}
+
+// dropRetries 待重试的消息都早于快照收到,由快照覆盖
+func (cc *Client) dropRetries() {
+	for k := range cc.retries {
+		delete(cc.retries, k)
+	}
+}
+
+// ListDeadLetters GET /api/v1/dead-letters
+func (cc *Client) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dead_letters": cc.deadLetters.list(),
+	})
+}
@@ -0,0 +1,149 @@
+package control
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"outputGuard/global"
+	. "outputGuard/logger"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// 未配置include时指向网关的网段,IPv6只在指定-iptables-gateway6时生效
+	defaultRouteInclude = []string{"0.0.0.0/0", "2000::/3"}
+	// 本网络、组播、保留与广播地址,总是不指向网关
+	reservedRouteNets = []string{"0.0.0.0/8", "224.0.0.0/3", "ff00::/8"}
+)
+
+/*
+ * RouteConfig router通过-route-config指定,为空时使用默认值
+ * 指向网关的网段为include去掉保留网段、内网网段、bypass与网关自身后的最小网段集合
+ */
+type RouteConfig struct {
+	Include []string `yaml:"include"`
+	// 直连不经过网关的网段,如云厂商的metadata、对象存储地址
+	Bypass []string `yaml:"bypass"`
+}
+
+func loadRouteConfig(path string) (*RouteConfig, error) {
+	config := &RouteConfig{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("无法读取路由配置文件: %v", err)
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("无法解析路由配置文件: %v", err)
+		}
+	}
+	if len(config.Include) == 0 {
+		config.Include = defaultRouteInclude
+	}
+	return config, nil
+}
+
+// routerOptions router与router plan共用的参数
+type routerOptions struct {
+	gateway      string
+	gateway6     string
+	internalFile string
+	configFile   string
+}
+
+func (o *routerOptions) bind(fs *flag.FlagSet) {
+	fs.StringVar(&o.gateway, "iptables-gateway", "", "设置路由网关ip")
+	fs.StringVar(&o.gateway6, "iptables-gateway6", "", "设置IPv6路由网关ip,为空时不添加IPv6路由")
+	fs.StringVar(&o.internalFile, "internal-networks-file", "", "内网网段文件,其中的网段不指向网关")
+	fs.StringVar(&o.configFile, "route-config", "", "路由配置文件,指定指向网关的网段与直连的网段")
+}
+
+// planRoutes 计算需要指向网关的网段,按地址排序
+func planRoutes(opts routerOptions) ([]*net.IPNet, error) {
+	gateway := net.ParseIP(opts.gateway)
+	if gateway.To4() == nil {
+		return nil, fmt.Errorf("网关地址无效")
+	}
+	excludes := []string{opts.gateway}
+	if opts.gateway6 != "" {
+		gateway6 := net.ParseIP(opts.gateway6)
+		if gateway6 == nil || gateway6.To4() != nil {
+			return nil, fmt.Errorf("IPv6网关地址无效")
+		}
+		excludes = append(excludes, opts.gateway6)
+	}
+	if err := loadInternalNetworks(opts.internalFile); err != nil {
+		return nil, fmt.Errorf("加载内网网段失败: %s", err.Error())
+	}
+	config, err := loadRouteConfig(opts.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	includes, err := global.ParseNets(config.Include)
+	if err != nil {
+		return nil, fmt.Errorf("include中%s", err.Error())
+	}
+	bypass, err := global.ParseNets(config.Bypass)
+	if err != nil {
+		return nil, fmt.Errorf("bypass中%s", err.Error())
+	}
+	excludes = append(excludes, reservedRouteNets...)
+	excludes = append(excludes, global.InternalNetworks(false)...)
+	excludes = append(excludes, global.InternalNetworks(true)...)
+	excludeNets, err := global.ParseNets(excludes)
+	if err != nil {
+		return nil, err
+	}
+	excludeNets = append(excludeNets, bypass...)
+
+	var routes []*net.IPNet
+	seen := make(map[string]bool)
+	for _, include := range includes {
+		// 没有IPv6网关时不添加IPv6路由
+		if include.IP.To4() == nil && opts.gateway6 == "" {
+			continue
+		}
+		for _, route := range global.SubtractNets(include, excludeNets) {
+			if seen[route.String()] {
+				continue
+			}
+			seen[route.String()] = true
+			routes = append(routes, route)
+		}
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if len(routes[i].IP) != len(routes[j].IP) {
+			return len(routes[i].IP) < len(routes[j].IP)
+		}
+		if c := bytes.Compare(routes[i].IP, routes[j].IP); c != 0 {
+			return c < 0
+		}
+		return routes[i].Mask.String() < routes[j].Mask.String()
+	})
+	return routes, nil
+}
+
+// Plan 输出router将要添加的路由,不修改路由表
+func Plan(args []string) {
+	var opts routerOptions
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	opts.bind(fs)
+	fs.Parse(args)
+
+	routes, err := planRoutes(opts)
+	if err != nil {
+		Logger.Panic(fmt.Sprintf("计算路由失败:%s", err.Error()))
+	}
+	for _, route := range routes {
+		gateway := opts.gateway
+		if route.IP.To4() == nil {
+			gateway = opts.gateway6
+		}
+		fmt.Printf("%s via %s\n", route.String(), gateway)
+	}
+}
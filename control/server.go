@@ -1,6 +1,9 @@
 package control
 
 import (
+	"fmt"
+	"outputGuard/global"
+	. "outputGuard/logger"
 	"outputGuard/model/orm"
 	"outputGuard/service"
 )
@@ -14,15 +17,35 @@ type Server struct {
 }
 
 func (cs *Server) RunServer() {
+	config, err := global.LoadServerConfig()
+	if err != nil {
+		Logger.Panic(fmt.Sprintf("加载server配置文件失败:%s", err.Error()))
+	}
+	if err := global.SetInternalNetworks(config.InternalNetworks); err != nil {
+		Logger.Panic(fmt.Sprintf("加载内网网段失败:%s", err.Error()))
+	}
 	wssServer := service.NewServer()
 	httpServer := &service.HttpServer{
 		WssServer: wssServer,
 		Ss:        &service.ServerService{},
+		Auth:      service.NewAuthenticator(config.Auth),
+	}
+	if config.TLS.Enabled() {
+		tlsConf, err := config.TLS.ServerTLSConfig()
+		if err != nil {
+			Logger.Panic(fmt.Sprintf("加载TLS配置失败:%s", err.Error()))
+		}
+		httpServer.TLS = tlsConf
+		httpServer.Auth.RequireGatewayCert = config.TLS.ClientCAFile != ""
+	} else {
+		Logger.Warn("未配置TLS,规则通过明文ws下发")
 	}
-	httpServer.WssServer.Orms = orm.NewORM()
+	httpServer.WssServer.Orms = orm.NewORM(config)
 	//解析已添加的域名
 	//当发现新的A记录时自动添加白名单
 	go cs.ss.LookupDomainIP(wssServer)
+	//删除过期条目
+	go httpServer.RunExpiryReaper(config.Expiry.CheckInterval, config.Expiry.WarnBefore)
 
 	httpServer.RunServerService()
 }
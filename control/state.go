@@ -0,0 +1,73 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"outputGuard/global"
+)
+
+const defaultStateFile = "/var/lib/outputguard/gateway-state.json"
+
+/*
+ * 最后一次从server收到的期望状态保存在本地
+ * gateway重启时先恢复这些规则再添加drop,server不可用时也不会中断已放行的出网访问
+ */
+type desiredState struct {
+	// 保存时server的revision,仅用于排查,server重启后revision会重新计数
+	Revision uint64            `json:"revision"`
+	SavedAt  time.Time         `json:"saved_at"`
+	Items    []global.Messages `json:"items"`
+}
+
+// loadState 文件不存在时返回nil
+func loadState(path string) (*desiredState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var state desiredState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("解析%s失败:%v", path, err)
+	}
+	return &state, nil
+}
+
+func saveState(path string, state desiredState) error {
+	return writeJSON(path, state)
+}
+
+// writeJSON 先写临时文件再rename,写入中途退出不会留下不完整的文件
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// desiredItems 按Key排序,保存的文件内容稳定
+func desiredItems(desired map[string]global.Messages) []global.Messages {
+	items := make([]global.Messages, 0, len(desired))
+	for _, m := range desired {
+		items = append(items, m)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key() < items[j].Key()
+	})
+	return items
+}
@@ -0,0 +1,54 @@
+package control
+
+import (
+	"flag"
+	"fmt"
+	. "outputGuard/logger"
+	"outputGuard/service"
+)
+
+/*
+ * gateway uninstall
+ * 删除outputGuard创建的链、跳转规则、ipset集合与nftables表
+ * 未指定后端时清理所有可用的后端,命令不存在的后端跳过
+ * 指定-migrate-legacy时同时删除旧版本写在内置链中的规则
+ */
+func Uninstall(args []string) {
+	fs := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	backend := fs.String("firewall-backend", "", "只清理指定的后端:iptables/ipset/nftables,为空时清理所有后端")
+	migrate := fs.Bool("migrate-legacy", false, "删除旧版本直接写在内置链中的规则,只删除地址在期望状态与内网网段中的规则")
+	stateFile := fs.String("state-file", defaultStateFile, "gateway保存期望状态的文件,-migrate-legacy时使用")
+	internalFile := fs.String("internal-networks-file", "", "内网网段文件,-migrate-legacy时使用")
+	fs.Parse(args)
+
+	backends := []string{service.BackendIpset, service.BackendIptables, service.BackendNftables}
+	if *backend != "" {
+		backends = []string{*backend}
+	}
+	failed := false
+	for _, b := range backends {
+		fw, err := service.NewFirewall(b)
+		if err != nil {
+			Logger.Warn(fmt.Sprintf("跳过%s:%s", b, err.Error()))
+			continue
+		}
+		if err := fw.Uninstall(); err != nil {
+			failed = true
+			Logger.Error(fmt.Sprintf("清理%s失败:%s", b, err.Error()))
+			continue
+		}
+		Logger.Info(fmt.Sprintf("%s已清理", b))
+	}
+	if *migrate {
+		if err := loadInternalNetworks(*internalFile); err != nil {
+			Logger.Panic(fmt.Sprintf("加载内网网段失败:%s", err.Error()))
+		}
+		if err := migrateLegacy(*stateFile); err != nil {
+			failed = true
+			Logger.Error(err.Error())
+		}
+	}
+	if failed {
+		Logger.Panic("卸载未完成")
+	}
+}
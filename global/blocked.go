@@ -0,0 +1,23 @@
+package global
+
+import (
+	"fmt"
+	"time"
+)
+
+// BlockedLogPrefix gateway记录被拦截连接的内核日志前缀,不能包含空格
+const BlockedLogPrefix = "og-blocked:"
+
+// BlockedFlow 一段时间内被拦截的新建连接,日志限速,Count只是下限
+type BlockedFlow struct {
+	Source   string    `json:"source"`
+	IP       string    `json:"ip"`
+	Protocol string    `json:"protocol"`
+	Port     int       `json:"port,omitempty"`
+	Count    uint64    `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func (b BlockedFlow) Key() string {
+	return fmt.Sprintf("%s>%s/%s:%d", b.Source, b.Protocol, b.IP, b.Port)
+}
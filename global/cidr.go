@@ -0,0 +1,62 @@
+package global
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+/*
+ * SubtractNets 从prefix中去掉excludes覆盖的部分,返回剩余部分的最小网段集合
+ * 网段之间只有包含与不相交两种关系,与excludes部分重叠时一分为二后继续处理
+ */
+func SubtractNets(prefix *net.IPNet, excludes []*net.IPNet) []*net.IPNet {
+	overlapped := false
+	for _, ex := range excludes {
+		if len(ex.IP) != len(prefix.IP) {
+			continue
+		}
+		if contains(ex, prefix) {
+			return nil
+		}
+		if contains(prefix, ex) {
+			overlapped = true
+		}
+	}
+	if !overlapped {
+		return []*net.IPNet{prefix}
+	}
+	low, high := splitNet(prefix)
+	return append(SubtractNets(low, excludes), SubtractNets(high, excludes)...)
+}
+
+// contains a是否包含b,两者需为同一地址族且IP长度一致
+func contains(a, b *net.IPNet) bool {
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	return aOnes <= bOnes && a.Contains(b.IP)
+}
+
+// splitNet 掩码加一位,分成前后两半
+func splitNet(n *net.IPNet) (*net.IPNet, *net.IPNet) {
+	ones, bits := n.Mask.Size()
+	mask := net.CIDRMask(ones+1, bits)
+	low := &net.IPNet{IP: append(net.IP{}, n.IP...), Mask: mask}
+	high := &net.IPNet{IP: append(net.IP{}, n.IP...), Mask: mask}
+	high.IP[ones/8] |= 0x80 >> uint(ones%8)
+	return low, high
+}
+
+// ParseNets 支持网段与单个ip,单个ip按/32或/128处理
+func ParseNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		normalized, err := normalizeSource(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("无效的网段:%s", cidr)
+		}
+		_, n, _ := net.ParseCIDR(normalized)
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -10,6 +10,9 @@ type ClientCache struct {
 	ExitsIpMap map[string]bool
 	Mu         sync.RWMutex
 	IpChan     chan Messages
+	AckChan    chan Ack
+	// 待上报给server的被拦截连接
+	BlockedChan chan []BlockedFlow
 }
 
 func (c *ClientCache) ClientSet(ip string) {
@@ -44,8 +47,10 @@ func (c *ClientCache) ClearClientCacheMap() {
 
 func NewClientCache() *ClientCache {
 	return &ClientCache{
-		ExitsIpMap: make(map[string]bool),
-		Mu:         sync.RWMutex{},
-		IpChan:     make(chan Messages, 10000),
+		ExitsIpMap:  make(map[string]bool),
+		Mu:          sync.RWMutex{},
+		IpChan:      make(chan Messages, 10000),
+		AckChan:     make(chan Ack, 10000),
+		BlockedChan: make(chan []BlockedFlow, 10),
 	}
 }
@@ -0,0 +1,101 @@
+package global
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ServerConfig server端配置文件,通过-server-conf-path指定
+type ServerConfig struct {
+	DbUser     string       `yaml:"db_user"`
+	DbPassword string       `yaml:"db_password"`
+	DbServer   string       `yaml:"db_server"`
+	DbPort     string       `yaml:"db_port"`
+	DbName     string       `yaml:"db_name"`
+	Auth       AuthConfig   `yaml:"auth"`
+	Expiry     ExpiryConfig `yaml:"expiry"`
+	TLS        TLSConfig    `yaml:"tls"`
+	// 在默认内网网段之外追加的网段,见internal.go
+	InternalNetworks []string `yaml:"internal_networks"`
+}
+
+type ExpiryConfig struct {
+	// 检查过期条目的间隔
+	CheckInterval time.Duration `yaml:"check_interval"`
+	// 过期前多久开始提醒
+	WarnBefore time.Duration `yaml:"warn_before"`
+}
+
+type AuthConfig struct {
+	// 未开启时所有请求都以approver身份处理,且不校验gateway
+	Enabled    bool            `yaml:"enabled"`
+	SessionTTL time.Duration   `yaml:"session_ttl"`
+	Users      []AuthUser      `yaml:"users"`
+	Tokens     []AuthToken     `yaml:"tokens"`
+	Gateways   []GatewayConfig `yaml:"gateways"`
+}
+
+// AuthUser 页面登录用户,密码为bcrypt哈希
+type AuthUser struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"`
+	Role         string `yaml:"role"`
+}
+
+// AuthToken api token,只保存token的sha256
+type AuthToken struct {
+	Name        string `yaml:"name"`
+	TokenSHA256 string `yaml:"token_sha256"`
+	Role        string `yaml:"role"`
+}
+
+// GatewayConfig 允许注册到/ws的gateway
+type GatewayConfig struct {
+	Hostname    string `yaml:"hostname"`
+	TokenSHA256 string `yaml:"token_sha256"`
+}
+
+func LoadServerConfig() (*ServerConfig, error) {
+	var configPath string
+	flag.StringVar(&configPath, "server-conf-path", "", "设置server配置文件路径")
+	flag.Parse()
+
+	if configPath == "" {
+		return nil, fmt.Errorf("配置文件路径不能为空")
+	}
+	file, err := os.Open(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("无法打开配置文件: %v", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取配置文件: %v", err)
+	}
+
+	var config ServerConfig
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("无法解析配置文件: %v", err)
+	}
+	if config.Auth.SessionTTL == 0 {
+		config.Auth.SessionTTL = 12 * time.Hour
+	}
+	if config.Expiry.CheckInterval == 0 {
+		config.Expiry.CheckInterval = time.Minute
+	}
+	if config.Expiry.WarnBefore == 0 {
+		config.Expiry.WarnBefore = 24 * time.Hour
+	}
+	if config.TLS.ClientCAFile != "" && !config.TLS.Enabled() {
+		return nil, fmt.Errorf("配置client_ca_file时必须同时配置cert_file与key_file")
+	}
+
+	return &config, nil
+}
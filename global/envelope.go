@@ -0,0 +1,50 @@
+package global
+
+/*
+ * server与gateway之间的消息信封
+ * server下发的每条消息带有递增的revision,gateway按顺序应用并回复ack
+ * gateway发现revision不连续时请求resync,server重新下发全量快照
+ */
+const (
+	// server -> gateway
+	EnvelopeMessage = "message"
+	// gateway -> server
+	EnvelopeAck       = "ack"
+	EnvelopeResync    = "resync"
+	EnvelopeHeartbeat = "heartbeat"
+	// 应用失败、等待重试,不推进已应用的revision
+	EnvelopeFailure = "failure"
+	// 定期上报被拦截的连接
+	EnvelopeBlocked = "blocked"
+)
+
+type Envelope struct {
+	Type     string    `json:"type"`
+	Revision uint64    `json:"revision,omitempty"`
+	Message  *Messages `json:"message,omitempty"`
+	// ack时gateway已连续应用到的revision
+	Applied uint64 `json:"applied,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// ack的是否为快照
+	Snapshot bool `json:"snapshot,omitempty"`
+	// 心跳时上报gateway当前的规则数
+	Rules int `json:"rules,omitempty"`
+	// 失败时的规则、已尝试次数以及是否已放弃重试
+	Key        string `json:"key,omitempty"`
+	Attempt    int    `json:"attempt,omitempty"`
+	DeadLetter bool   `json:"dead_letter,omitempty"`
+	// 上次上报以来被拦截的连接
+	Blocked []BlockedFlow `json:"blocked,omitempty"`
+}
+
+// Ack gateway应用完一条消息后写入ClientCache.AckChan,由WebSocketClient发送给server
+type Ack struct {
+	Revision uint64
+	Snapshot bool
+	Error    string
+	// 以下只在失败时使用,Retrying为true时以failure发送
+	Key        string
+	Attempt    int
+	DeadLetter bool
+	Retrying   bool
+}
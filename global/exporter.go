@@ -1,5 +1,10 @@
 package global
 
+import (
+	"net"
+	"strings"
+)
+
 type ExporterData struct {
 	ChainName string
 	Ip        string
@@ -7,9 +12,24 @@ type ExporterData struct {
 	Bytes     float64
 	Hostname  string
 	Direction string
+	// 组成该ip计数的每条规则(或集合元素)的计数,累加总量时按规则判断计数是否归零
+	Rules []RuleCounter
 }
 
-var (
-	ExporterDatas = make(chan ExporterData, 100000)
-	RunSig        = make(chan struct{})
-)
+// RuleCounter 单条规则或集合元素的计数,Key在规则存在期间保持不变
+type RuleCounter struct {
+	Key     string
+	Packets float64
+	Bytes   float64
+}
+
+// ExporterAddr 与iptables输出保持一致,单个地址带上掩码
+func ExporterAddr(addr string) string {
+	if strings.Contains(addr, "/") {
+		return addr
+	}
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return addr + "/128"
+	}
+	return addr + "/32"
+}
@@ -0,0 +1,125 @@
+package global
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * 内网网段,server据此标记内网ip,gateway据此放行内网访问,router据此计算需要指向gateway的网段
+ * 默认网段总是包含在内,配置中的网段(包括自有的公网网段)在默认网段之外追加
+ */
+var (
+	defaultInternalNets = []string{
+		"127.0.0.0/8",
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"100.64.0.0/10",
+		"169.254.0.0/16",
+		"255.255.255.255/32",
+	}
+	defaultInternalNets6 = []string{"::1/128", "fc00::/7", "fe80::/10"}
+
+	internalMu    sync.RWMutex
+	internalNets  = defaultInternalNets
+	internalNets6 = defaultInternalNets6
+	internalIPNet = mustParseNets(append(append([]string{}, defaultInternalNets...), defaultInternalNets6...))
+)
+
+// InternalConfig gateway与router通过-internal-networks-file指定,格式与server配置中的internal_networks相同
+type InternalConfig struct {
+	InternalNetworks []string `yaml:"internal_networks"`
+}
+
+// LoadInternalNetworks path为空时返回nil,只使用默认网段
+func LoadInternalNetworks(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取内网网段文件: %v", err)
+	}
+	var config InternalConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("无法解析内网网段文件: %v", err)
+	}
+	return config.InternalNetworks, nil
+}
+
+// SetInternalNetworks 在默认网段之外追加网段,需在启动时、使用内网网段之前调用
+func SetInternalNetworks(extra []string) error {
+	nets := append([]string{}, defaultInternalNets...)
+	nets6 := append([]string{}, defaultInternalNets6...)
+	seen := make(map[string]bool)
+	for _, n := range append(append([]string{}, nets...), nets6...) {
+		seen[n] = true
+	}
+	for _, n := range extra {
+		cidr, err := normalizeSource(strings.TrimSpace(n))
+		if err != nil {
+			return fmt.Errorf("内网网段%s无效", n)
+		}
+		if seen[cidr] {
+			continue
+		}
+		seen[cidr] = true
+		if strings.Contains(cidr, ":") {
+			nets6 = append(nets6, cidr)
+		} else {
+			nets = append(nets, cidr)
+		}
+	}
+	internalMu.Lock()
+	defer internalMu.Unlock()
+	internalNets, internalNets6 = nets, nets6
+	internalIPNet = mustParseNets(append(append([]string{}, nets...), nets6...))
+	return nil
+}
+
+// InternalNetworks 某个地址族的内网网段
+func InternalNetworks(v6 bool) []string {
+	internalMu.RLock()
+	defer internalMu.RUnlock()
+	if v6 {
+		return append([]string{}, internalNets6...)
+	}
+	return append([]string{}, internalNets...)
+}
+
+// IsInternalIP 支持地址与网段,网段按网络地址判断
+func IsInternalIP(addr string) (bool, error) {
+	if strings.Contains(addr, "/") {
+		addr = strings.Split(addr, "/")[0]
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false, fmt.Errorf("无效的IP地址")
+	}
+	internalMu.RLock()
+	defer internalMu.RUnlock()
+	for _, block := range internalIPNet {
+		if block.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func mustParseNets(cidrs []string) []*net.IPNet {
+	blocks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
@@ -1,7 +1,86 @@
 package global
 
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// 消息类型,snapshot为server端期望的全部规则,gateway据此增删规则
+const (
+	ActionAdd      = "add"
+	ActionDel      = "del"
+	ActionSnapshot = "snapshot"
+)
+
 type Messages struct {
 	IP         string `json:"ip"`
 	Action     string `json:"action"`
 	IsLocalNet bool
+	// 协议为空表示所有协议所有端口
+	Protocol string `json:"protocol,omitempty"`
+	Ports    string `json:"ports,omitempty"`
+	// 允许访问的源网段,逗号分隔,为空表示不限制
+	Sources string `json:"sources,omitempty"`
+	// 引用该规则的条目,gateway用于在监控中标注ip
+	Entries []EntryRef `json:"entries,omitempty"`
+	// 仅snapshot消息使用
+	Items []Messages `json:"items,omitempty"`
+	// 所属信封的revision,只在gateway本地使用
+	Revision uint64 `json:"-"`
+}
+
+// EntryRef 条目的标识,不参与规则的比较
+type EntryRef struct {
+	ID    uint   `json:"id"`
+	Name  string `json:"name"`
+	Owner string `json:"owner,omitempty"`
+}
+
+// MergeEntries 按条目id合并,后出现的覆盖先出现的
+func MergeEntries(a, b []EntryRef) []EntryRef {
+	merged := make([]EntryRef, 0, len(a)+len(b))
+	index := make(map[uint]int, len(a)+len(b))
+	for _, ref := range append(append([]EntryRef{}, a...), b...) {
+		if i, ok := index[ref.ID]; ok {
+			merged[i] = ref
+			continue
+		}
+		index[ref.ID] = len(merged)
+		merged = append(merged, ref)
+	}
+	return merged
+}
+
+// Key 同一个ip不同的协议/端口/源网段是不同的规则
+func (m Messages) Key() string {
+	key := CanonicalAddr(m.IP)
+	if m.Protocol != "" && m.Ports == "" {
+		key = fmt.Sprintf("%s/%s", m.Protocol, key)
+	} else if m.Protocol != "" {
+		key = fmt.Sprintf("%s/%s:%s", m.Protocol, key, m.Ports)
+	}
+	if m.Sources == "" {
+		return key
+	}
+	return fmt.Sprintf("%s from %s", key, m.Sources)
+}
+
+// CanonicalAddr 与iptables输出的格式保持一致,单个地址去掉/32与/128,网段取网络地址
+func CanonicalAddr(addr string) string {
+	if !strings.Contains(addr, "/") {
+		if ip := net.ParseIP(addr); ip != nil {
+			return ip.String()
+		}
+		return addr
+	}
+	ip, ipNet, err := net.ParseCIDR(addr)
+	if err != nil {
+		return addr
+	}
+	ones, bits := ipNet.Mask.Size()
+	if ones == bits {
+		return ip.String()
+	}
+	return ipNet.String()
 }
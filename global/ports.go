@@ -0,0 +1,73 @@
+package global
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// iptables multiport最多支持15个端口,端口范围占两个
+const maxMultiports = 15
+
+var protocols = map[string]bool{
+	"tcp": true,
+	"udp": true,
+}
+
+/*
+ * 校验并规范化协议与端口
+ * 协议为空表示所有协议,此时不能指定端口
+ * 端口格式: 443 / 8000-8100 / 80,443,8000-8100
+ */
+func NormalizePortSpec(protocol, ports string) (string, string, error) {
+	protocol = strings.ToLower(strings.TrimSpace(protocol))
+	ports = strings.ReplaceAll(strings.TrimSpace(ports), " ", "")
+	if protocol == "" {
+		if ports != "" {
+			return "", "", fmt.Errorf("指定端口时必须指定协议")
+		}
+		return "", "", nil
+	}
+	if !protocols[protocol] {
+		return "", "", fmt.Errorf("不支持的协议:%s", protocol)
+	}
+	if ports == "" {
+		return protocol, "", nil
+	}
+
+	used := 0
+	normalized := make([]string, 0)
+	for _, part := range strings.Split(ports, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		from, err := parsePort(bounds[0])
+		if err != nil {
+			return "", "", err
+		}
+		if len(bounds) == 1 {
+			used++
+			normalized = append(normalized, strconv.Itoa(from))
+			continue
+		}
+		to, err := parsePort(bounds[1])
+		if err != nil {
+			return "", "", err
+		}
+		if from >= to {
+			return "", "", fmt.Errorf("无效的端口范围:%s", part)
+		}
+		used += 2
+		normalized = append(normalized, fmt.Sprintf("%d-%d", from, to))
+	}
+	if used > maxMultiports {
+		return "", "", fmt.Errorf("端口数量超过%d个(端口范围计为2个)", maxMultiports)
+	}
+	return protocol, strings.Join(normalized, ","), nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("无效的端口:%s", s)
+	}
+	return port, nil
+}
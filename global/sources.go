@@ -0,0 +1,92 @@
+package global
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+/*
+ * 允许访问目的地址的源网段
+ * 为空表示所有经过gateway的机器都可以访问
+ * 规则中需要完整携带源网段,数量与长度有上限:
+ * iptables注释最长256字节;nftables的集合与计数器名最长255个字符,
+ * 计数器名为 o_<协议/端口,最长93>__<源网段>_<IPv6网段,最长43>,源网段不超过110个字符时不会超长
+ */
+const (
+	maxSources      = 8
+	maxSourcesBytes = 110
+)
+
+// NormalizeSources 校验并规范化源网段,去重后排序,以逗号连接
+func NormalizeSources(sources []string) (string, error) {
+	seen := make(map[string]bool, len(sources))
+	normalized := make([]string, 0, len(sources))
+	for _, source := range sources {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		cidr, err := normalizeSource(source)
+		if err != nil {
+			return "", err
+		}
+		if seen[cidr] {
+			continue
+		}
+		seen[cidr] = true
+		normalized = append(normalized, cidr)
+	}
+	if len(normalized) > maxSources {
+		return "", fmt.Errorf("源网段数量超过%d个", maxSources)
+	}
+	sort.Strings(normalized)
+	joined := strings.Join(normalized, ",")
+	if len(joined) > maxSourcesBytes {
+		return "", fmt.Errorf("源网段总长度超过%d个字符", maxSourcesBytes)
+	}
+	return joined, nil
+}
+
+// normalizeSource 单个地址补全为/32或/128,网段取网络地址
+func normalizeSource(source string) (string, error) {
+	if !strings.Contains(source, "/") {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return "", fmt.Errorf("无效的源网段:%s", source)
+		}
+		if ip.To4() != nil {
+			return ip.String() + "/32", nil
+		}
+		return ip.String() + "/128", nil
+	}
+	_, ipNet, err := net.ParseCIDR(source)
+	if err != nil {
+		return "", fmt.Errorf("无效的源网段:%s", source)
+	}
+	return ipNet.String(), nil
+}
+
+// SplitSources 源网段为空时返回空切片
+func SplitSources(sources string) []string {
+	if sources == "" {
+		return []string{}
+	}
+	return strings.Split(sources, ",")
+}
+
+// SourcesFor 与目的地址同一地址族的源网段
+func (m Messages) SourcesFor(v6 bool) []string {
+	res := make([]string, 0)
+	for _, source := range SplitSources(m.Sources) {
+		ip, _, err := net.ParseCIDR(source)
+		if err != nil {
+			continue
+		}
+		if (ip.To4() == nil) == v6 {
+			res = append(res, source)
+		}
+	}
+	return res
+}
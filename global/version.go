@@ -0,0 +1,4 @@
+package global
+
+// Version 构建时通过 -ldflags "-X outputGuard/global.Version=..." 注入
+var Version = "dev"
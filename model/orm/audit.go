@@ -0,0 +1,57 @@
+package orm
+
+import (
+	"time"
+)
+
+// AuditLog 白名单变更审计记录,只追加不修改
+type AuditLog struct {
+	ID        uint      `gorm:"primaryKey"`
+	Actor     string    `gorm:"column:actor;index"`
+	SourceIP  string    `gorm:"column:source_ip"`
+	Action    string    `gorm:"column:action"`
+	EntryID   uint      `gorm:"column:entry_id;index"`
+	EntryName string    `gorm:"column:entry_name"`
+	IPs       string    `gorm:"column:ips;type:text"`
+	Reason    string    `gorm:"column:reason;type:text"`
+	Before    string    `gorm:"column:before_state;type:text"`
+	After     string    `gorm:"column:after_state;type:text"`
+	CreatedAt time.Time `gorm:"column:created_at;index"`
+}
+
+// AuditFilter 为零值的字段不参与过滤
+type AuditFilter struct {
+	EntryID uint
+	Actor   string
+	Action  string
+	Since   time.Time
+	Limit   int
+}
+
+func (orm *ORM) AddAudit(log *AuditLog) error {
+	return orm.db.Create(log).Error
+}
+
+func (orm *ORM) QueryAudits(filter AuditFilter) ([]AuditLog, error) {
+	query := orm.db.Model(&AuditLog{})
+	if filter.EntryID != 0 {
+		query = query.Where("entry_id = ?", filter.EntryID)
+	}
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if filter.Limit <= 0 || filter.Limit > 1000 {
+		filter.Limit = 100
+	}
+	var res []AuditLog
+	if err := query.Order("id DESC").Limit(filter.Limit).Find(&res).Error; err != nil {
+		return nil, err
+	}
+	return res, nil
+}
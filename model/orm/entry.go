@@ -0,0 +1,221 @@
+package orm
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 条目状态,pending的条目在审批前不会下发给gateway
+const (
+	EntryStatusActive  = "active"
+	EntryStatusPending = "pending"
+	// 已过期但仍保留了不可删除的ip,不再参与过期检查
+	EntryStatusExpired = "expired"
+)
+
+// Entry 白名单条目,一个域名/IP/网段对应一个条目,条目下挂载解析出的所有ip
+type Entry struct {
+	ID      uint   `gorm:"primaryKey"`
+	Types   string `gorm:"column:types"`
+	Name    string `gorm:"column:name;index"`
+	IsNoDel bool   `gorm:"column:is_no_del"`
+	Status  string `gorm:"column:status;default:active"`
+	Owner   string `gorm:"column:owner"`
+	// 为空表示所有协议所有端口
+	Protocol string `gorm:"column:protocol;not null;default:''"`
+	Ports    string `gorm:"column:ports;not null;default:''"`
+	// 允许访问的源网段,为空表示不限制
+	Sources string `gorm:"column:sources;not null;default:''"`
+	// 为空表示永不过期
+	ExpiresAt      *time.Time     `gorm:"column:expires_at;index"`
+	ExpiryWarnedAt *time.Time     `gorm:"column:expiry_warned_at"`
+	CreatedAt      time.Time      `gorm:"column:created_at"`
+	UpdatedAt      time.Time      `gorm:"column:updated_at"`
+	IPs            []CrawlerProxy `gorm:"foreignKey:EntryID"`
+}
+
+func (orm *ORM) CreateEntry(entry *Entry) error {
+	return orm.db.Omit("IPs").Create(entry).Error
+}
+
+// GetEntry 条目不存在时返回nil
+func (orm *ORM) GetEntry(id uint) (*Entry, error) {
+	var res Entry
+	if err := orm.db.Preload("IPs").Where("id = ?", id).Find(&res).Error; err != nil {
+		return nil, err
+	}
+	if res.ID == 0 {
+		return nil, nil
+	}
+	return &res, nil
+}
+
+// GetEntryByTarget 同一个名字不同协议/端口/源网段是不同的条目,条目不存在时返回nil
+func (orm *ORM) GetEntryByTarget(name, protocol, ports, sources string) (*Entry, error) {
+	var res Entry
+	if err := orm.db.Preload("IPs").Where("name = ? AND protocol = ? AND ports = ? AND sources = ?", name, protocol, ports, sources).Find(&res).Error; err != nil {
+		return nil, err
+	}
+	if res.ID == 0 {
+		return nil, nil
+	}
+	return &res, nil
+}
+
+// ListDomainEntries 查询需要定期重新解析的域名条目
+func (orm *ORM) ListDomainEntries() ([]Entry, error) {
+	var res []Entry
+	if err := orm.db.Preload("IPs").Where("types = ? AND status = ?", "domain", EntryStatusActive).Order("id").Find(&res).Error; err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListEntryRefs 只查询条目的id、名字与创建人,不加载ip
+func (orm *ORM) ListEntryRefs() ([]Entry, error) {
+	var res []Entry
+	err := orm.db.Select("id", "name", "owner").Find(&res).Error
+	return res, err
+}
+
+func (orm *ORM) ListEntries() ([]Entry, error) {
+	var res []Entry
+	if err := orm.db.Preload("IPs").Order("id").Find(&res).Error; err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (orm *ORM) UpdateEntryStatus(id uint, status string) error {
+	return orm.db.Model(&Entry{}).Where("id = ?", id).Update("status", status).Error
+}
+
+// SetEntryExpiry expiresAt为nil时取消过期时间,同时重置过期提醒
+func (orm *ORM) SetEntryExpiry(id uint, expiresAt *time.Time) error {
+	return orm.db.Model(&Entry{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"expires_at":       expiresAt,
+		"expiry_warned_at": nil,
+	}).Error
+}
+
+func (orm *ORM) MarkExpiryWarned(id uint, warnedAt time.Time) error {
+	return orm.db.Model(&Entry{}).Where("id = ?", id).Update("expiry_warned_at", warnedAt).Error
+}
+
+// QueryExpiredEntries 查询已过期的条目,不可删除的条目与已处理过的过期条目不参与自动删除
+func (orm *ORM) QueryExpiredEntries(now time.Time) ([]Entry, error) {
+	var res []Entry
+	if err := orm.db.Preload("IPs").Where("is_no_del = ? AND status <> ? AND expires_at IS NOT NULL AND expires_at <= ?", false, EntryStatusExpired, now).Find(&res).Error; err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// QueryExpiringEntries 查询before之前将过期且尚未提醒过的条目
+func (orm *ORM) QueryExpiringEntries(before time.Time) ([]Entry, error) {
+	var res []Entry
+	if err := orm.db.Where("is_no_del = ? AND expires_at IS NOT NULL AND expires_at <= ? AND expiry_warned_at IS NULL", false, before).Find(&res).Error; err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UpdateEntryNoDel 同步更新条目下的ip,内网ip始终不可删除
+func (orm *ORM) UpdateEntryNoDel(id uint, isNoDel bool) error {
+	return orm.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Entry{}).Where("id = ?", id).Update("is_no_del", isNoDel).Error; err != nil {
+			return err
+		}
+		return tx.Model(&CrawlerProxy{}).Where("entry_id = ? AND is_local_net = ?", id, false).Update("is_no_del", isNoDel).Error
+	})
+}
+
+// AddEntryIP 向条目添加ip,返回值表示是否为新增
+func (orm *ORM) AddEntryIP(entry *Entry, ip string, isNoDel, isLocalNet bool) (bool, error) {
+	var res CrawlerProxy
+	if err := orm.db.Where("entry_id = ? AND ip = ?", entry.ID, ip).Find(&res).Error; err != nil {
+		return false, err
+	}
+	if res.ID != 0 {
+		return false, nil
+	}
+	if err := orm.db.Create(&CrawlerProxy{
+		EntryID:    entry.ID,
+		IP:         ip,
+		Types:      entry.Types,
+		Name:       entry.Name,
+		Protocol:   entry.Protocol,
+		Ports:      entry.Ports,
+		Sources:    entry.Sources,
+		CreatedAt:  time.Now().Local(),
+		IsNoDel:    isNoDel,
+		IsLocalNet: isLocalNet,
+	}).Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (orm *ORM) DelEntryIP(entryID uint, ip string) error {
+	return orm.db.Where("entry_id = ? AND ip = ?", entryID, ip).Delete(&CrawlerProxy{}).Error
+}
+
+// DeleteEntry 只删除条目本身,条目下的ip需先通过DelEntryIP删除
+func (orm *ORM) DeleteEntry(id uint) error {
+	return orm.db.Where("id = ?", id).Delete(&Entry{}).Error
+}
+
+// IPRefCount 统计ip+协议+端口+源网段被多少个条目引用,多个域名可能解析到同一个ip
+func (orm *ORM) IPRefCount(ip, protocol, ports, sources string) (int64, error) {
+	var count int64
+	if err := orm.db.Model(&CrawlerProxy{}).Where("ip = ? AND protocol = ? AND ports = ? AND sources = ?", ip, protocol, ports, sources).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// EntryRefsFor 引用ip+协议+端口+源网段的所有条目,只查询条目的id、名字与创建人
+func (orm *ORM) EntryRefsFor(ip, protocol, ports, sources string) ([]Entry, error) {
+	var res []Entry
+	err := orm.db.Model(&Entry{}).Distinct("entries.id", "entries.name", "entries.owner").
+		Joins("JOIN crawler_proxies ON crawler_proxies.entry_id = entries.id").
+		Where("crawler_proxies.ip = ? AND crawler_proxies.protocol = ? AND crawler_proxies.ports = ? AND crawler_proxies.sources = ?", ip, protocol, ports, sources).
+		Order("entries.id").Find(&res).Error
+	return res, err
+}
+
+// backfillEntries 为旧版本没有条目的ip按名字补建条目
+func (orm *ORM) backfillEntries() error {
+	var orphans []CrawlerProxy
+	if err := orm.db.Where("entry_id = ?", 0).Order("id").Find(&orphans).Error; err != nil {
+		return err
+	}
+	entries := make(map[string]*Entry)
+	for _, row := range orphans {
+		entry, ok := entries[row.Name]
+		if !ok {
+			existing, err := orm.GetEntryByTarget(row.Name, "", "", "")
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				existing = &Entry{
+					Types:     row.Types,
+					Name:      row.Name,
+					IsNoDel:   row.IsNoDel && !row.IsLocalNet,
+					CreatedAt: row.CreatedAt,
+				}
+				if err := orm.CreateEntry(existing); err != nil {
+					return err
+				}
+			}
+			entry = existing
+			entries[row.Name] = entry
+		}
+		if err := orm.db.Model(&CrawlerProxy{}).Where("id = ?", row.ID).Update("entry_id", entry.ID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,15 +1,12 @@
 package orm
 
 import (
-	"flag"
 	"fmt"
-	"io"
-	"os"
 	"time"
 
+	"outputGuard/global"
 	. "outputGuard/logger"
 
-	"gopkg.in/yaml.v2"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
@@ -17,11 +14,15 @@ import (
 
 type CrawlerProxy struct {
 	ID         uint      `gorm:"primaryKey"`
+	EntryID    uint      `gorm:"column:entry_id;index"`
 	Types      string    `gorm:"column:types"`
 	IP         string    `gorm:"column:ip"`
 	Name       string    `gorm:"column:name"`
 	IsNoDel    bool      `gorm:"column:is_no_del"`
 	IsLocalNet bool      `gorm:"column:is_local_net"`
+	Protocol   string    `gorm:"column:protocol;not null;default:''"`
+	Ports      string    `gorm:"column:ports;not null;default:''"`
+	Sources    string    `gorm:"column:sources;not null;default:''"`
 	CreatedAt  time.Time `gorm:"column:created_at"`
 }
 
@@ -31,48 +32,7 @@ type ORM struct {
 	db *gorm.DB
 }
 
-type config struct {
-	DbUser     string `yaml:"db_user"`
-	DbPassword string `yaml:"db_password"`
-	DbServer   string `yaml:"db_server"`
-	DbPort     string `yaml:"db_port"`
-	DbName     string `yaml:"db_name"`
-}
-
-func LoadConfig() (*config, error) {
-	var configPath string
-	flag.StringVar(&configPath, "server-conf-path", "", "设置server配置文件路径")
-	flag.Parse()
-
-	if configPath == "" {
-		return nil, fmt.Errorf("配置文件路径不能为空")
-	}
-	file, err := os.Open(configPath)
-	if err != nil {
-		return nil, fmt.Errorf("无法打开配置文件: %v", err)
-	}
-	defer file.Close()
-
-	data, err := io.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("无法读取配置文件: %v", err)
-	}
-
-	var config config
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		return nil, fmt.Errorf("无法解析配置文件: %v", err)
-	}
-
-	return &config, nil
-}
-
-func NewORM() *ORM {
-	config, err := LoadConfig()
-	if err != nil {
-		Logger.Panic(fmt.Sprintf("加载server配置文件失败:%s", err.Error()))
-		return nil
-	}
+func NewORM(config *global.ServerConfig) *ORM {
 	rootDSN := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8&parseTime=True&loc=Local", config.DbUser, config.DbPassword, config.DbServer, config.DbPort, config.DbName)
 	// 创建 Gorm 的 DB 对象
 	rootDB, err := gorm.Open(mysql.New(mysql.Config{
@@ -97,15 +57,45 @@ func NewORM() *ORM {
 	sqlDB.SetConnMaxLifetime(time.Second * 10) // 设置连接的最大存活时间
 	sqlDB.SetConnMaxIdleTime(time.Second * 10) // 设置连接的最大空闲时间
 
-	migrator := rootDB.Migrator()
-	if !migrator.HasTable(&CrawlerProxy{}) {
-		if err := rootDB.AutoMigrate(&CrawlerProxy{}); err != nil {
-			Logger.Panic(fmt.Sprintf("数据库migrator失败:%s", err.Error()))
-			return nil
-		}
+	// 旧版本添加的列允许为NULL,改为NOT NULL前先把NULL改为空字符串
+	if err := fillNullColumns(rootDB, &CrawlerProxy{}, "protocol", "ports", "sources"); err != nil {
+		Logger.Panic(fmt.Sprintf("数据库migrator失败:%s", err.Error()))
+		return nil
+	}
+	if err := fillNullColumns(rootDB, &Entry{}, "protocol", "ports", "sources"); err != nil {
+		Logger.Panic(fmt.Sprintf("数据库migrator失败:%s", err.Error()))
+		return nil
+	}
+	if err := rootDB.AutoMigrate(&CrawlerProxy{}, &Entry{}, &AuditLog{}); err != nil {
+		Logger.Panic(fmt.Sprintf("数据库migrator失败:%s", err.Error()))
+		return nil
 	}
 
-	return &ORM{db: rootDB}
+	orm := &ORM{db: rootDB}
+	if err := orm.backfillEntries(); err != nil {
+		Logger.Panic(fmt.Sprintf("补建白名单条目失败:%s", err.Error()))
+		return nil
+	}
+	return orm
+}
+
+/*
+ * fillNullColumns 把已存在的列中的NULL改为空字符串
+ * 查询按空字符串匹配未指定协议/端口/源网段的规则,NULL不会被匹配到
+ */
+func fillNullColumns(db *gorm.DB, model interface{}, columns ...string) error {
+	if !db.Migrator().HasTable(model) {
+		return nil
+	}
+	for _, column := range columns {
+		if !db.Migrator().HasColumn(model, column) {
+			continue
+		}
+		if err := db.Model(model).Where(column+" IS NULL").Update(column, "").Error; err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (orm *ORM) Add(Types, ip, Name string, CreatedAt time.Time, isNoDel, isLocalNet bool) error {
@@ -0,0 +1,21 @@
+package pkg
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// gateway应用规则失败的统计
+var (
+	ApplyRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outputguard_apply_retries_total",
+			Help: "Number of failed rule applications scheduled for retry",
+		},
+		[]string{"hostname"},
+	)
+	DeadLetters = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "outputguard_dead_letters",
+			Help: "Number of rule operations that exhausted their retries",
+		},
+		[]string{"hostname"},
+	)
+)
@@ -0,0 +1,12 @@
+package pkg
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// 被拦截的新建连接,内核日志限速,只是下限
+var BlockedConnections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "outputguard_blocked_connections_total",
+		Help: "Logged new connections dropped because the destination is not whitelisted",
+	},
+	[]string{"hostname", "ip", "protocol", "port"},
+)
@@ -0,0 +1,23 @@
+package pkg
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// gateway漂移检测的统计
+var (
+	// result: clean/repaired/failed
+	DriftChecks = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outputguard_drift_checks_total",
+			Help: "Number of drift checks by result",
+		},
+		[]string{"hostname", "result"},
+	)
+	// kind: missing/unexpected/structure
+	DriftCorrections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outputguard_drift_corrections_total",
+			Help: "Number of drifted rules found and corrected by kind",
+		},
+		[]string{"hostname", "kind"},
+	)
+)
@@ -5,13 +5,61 @@ import (
 	"net/http"
 	"outputGuard/global"
 	. "outputGuard/logger"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+/*
+ * CounterSnapshot gateway按自己的间隔采集的流量计数
+ * 采集与抓取互不阻塞,任意数量的并发抓取只读取最后一次成功采集的结果
+ * 同时把规则的计数累加为单调递增的总量,见totals.go
+ */
+type CounterSnapshot struct {
+	mutex    sync.RWMutex
+	data     []global.ExporterData
+	updated  time.Time
+	duration time.Duration
+	totals   map[string]*CounterTotal
+}
+
+var Counters = &CounterSnapshot{totals: make(map[string]*CounterTotal)}
+
+// Update 替换为新采集的计数并累加总量,duration为本次采集的耗时
+func (cs *CounterSnapshot) Update(data []global.ExporterData, duration time.Duration) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.data = data
+	cs.updated = time.Now()
+	cs.duration = duration
+	cs.accumulate(data, cs.updated)
+}
+
+// Get 返回的切片不会再被修改,调用方不能修改其中的元素
+func (cs *CounterSnapshot) Get() ([]global.ExporterData, time.Time, time.Duration) {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	return cs.data, cs.updated, cs.duration
+}
+
+// 采集计数的统计,result: success/failed
+var CounterCollections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "outputguard_counter_collections_total",
+		Help: "Number of firewall counter collections by result",
+	},
+	[]string{"result"},
+)
+
 type NodeCollector struct {
 	IptablesCounters IptablesCounter
+	snapshot         *CounterSnapshot
+	ageDesc          *prometheus.Desc
+	durationDesc     *prometheus.Desc
+	packetsTotalDesc *prometheus.Desc
+	bytesTotalDesc   *prometheus.Desc
 }
 
 type IptablesCounter []struct {
@@ -20,7 +68,7 @@ type IptablesCounter []struct {
 	valType     prometheus.ValueType
 }
 
-func NewNodeCollector() prometheus.Collector {
+func NewNodeCollector(snapshot *CounterSnapshot) prometheus.Collector {
 	return &NodeCollector{
 		IptablesCounters: IptablesCounter{
 			{
@@ -39,19 +87,56 @@ func NewNodeCollector() prometheus.Collector {
 				valType: prometheus.GaugeValue,
 			},
 		},
+		snapshot: snapshot,
+		ageDesc: prometheus.NewDesc(
+			"outputguard_counters_age_seconds",
+			"Seconds since the firewall counters were last collected successfully, -1 before the first collection",
+			nil,
+			nil,
+		),
+		durationDesc: prometheus.NewDesc(
+			"outputguard_counters_collect_duration_seconds",
+			"Duration of the last successful firewall counter collection",
+			nil,
+			nil,
+		),
+		packetsTotalDesc: prometheus.NewDesc(
+			"outputguard_packets_total",
+			"Packets forwarded to each whitelisted ip, monotonic across rule re-creation",
+			[]string{"hostname", "ip", "direction"},
+			nil,
+		),
+		bytesTotalDesc: prometheus.NewDesc(
+			"outputguard_bytes_total",
+			"Bytes forwarded to each whitelisted ip, monotonic across rule re-creation",
+			[]string{"hostname", "ip", "direction"},
+			nil,
+		),
 	}
 }
 
 func (n *NodeCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- n.IptablesCounters[0].packetsDesc
 	ch <- n.IptablesCounters[0].bytesDesc
+	ch <- n.ageDesc
+	ch <- n.durationDesc
+	ch <- n.packetsTotalDesc
+	ch <- n.bytesTotalDesc
 }
 
 func (n *NodeCollector) Collect(ch chan<- prometheus.Metric) {
-	for ge := range global.ExporterDatas {
-		if ge.ChainName == "done" {
-			break
-		}
+	for _, total := range n.snapshot.Totals() {
+		ch <- prometheus.MustNewConstMetric(n.packetsTotalDesc, prometheus.CounterValue, total.Packets, total.Hostname, total.Ip, total.Direction)
+		ch <- prometheus.MustNewConstMetric(n.bytesTotalDesc, prometheus.CounterValue, total.Bytes, total.Hostname, total.Ip, total.Direction)
+	}
+	data, updated, duration := n.snapshot.Get()
+	age := -1.0
+	if !updated.IsZero() {
+		age = time.Since(updated).Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(n.ageDesc, prometheus.GaugeValue, age)
+	ch <- prometheus.MustNewConstMetric(n.durationDesc, prometheus.GaugeValue, duration.Seconds())
+	for _, ge := range data {
 		ch <- prometheus.MustNewConstMetric(
 			n.IptablesCounters[0].packetsDesc,
 			n.IptablesCounters[0].valType,
@@ -72,15 +157,14 @@ func (n *NodeCollector) Collect(ch chan<- prometheus.Metric) {
 			ge.Direction,
 			"bytes_count",
 		)
-
 	}
-	global.RunSig <- struct{}{}
 }
 
 func RunExporter() {
 	registry := prometheus.NewRegistry()
 
-	registry.MustRegister(NewNodeCollector())
+	registry.MustRegister(NewNodeCollector(Counters), CounterCollections, EntryInfos)
+	registry.MustRegister(DriftChecks, DriftCorrections, ApplyRetries, DeadLetters, SourcePackets, SourceBytes, BlockedConnections)
 	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry}))
 	if err := http.ListenAndServe(":9900", nil); err != nil {
 		Logger.Error(fmt.Sprintf("监控程序监听端口失败!，错误信息:%s", err.Error()))
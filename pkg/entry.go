@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// EntryInfo 白名单ip所属的条目,ip的格式与iptables_*的ip标签一致
+type EntryInfo struct {
+	Hostname string
+	IP       string
+	EntryID  uint
+	Name     string
+	Owner    string
+}
+
+/*
+ * entryInfoCollector 每个ip与条目的组合暴露一条值为1的序列,在PromQL中与流量指标按ip关联
+ * gateway的期望状态变化后整体替换,抓取时只读取
+ */
+type entryInfoCollector struct {
+	mutex sync.RWMutex
+	infos []EntryInfo
+	desc  *prometheus.Desc
+}
+
+var EntryInfos = &entryInfoCollector{
+	desc: prometheus.NewDesc(
+		"outputguard_entry_info",
+		"Whitelist entries referencing each ip, always 1",
+		[]string{"hostname", "ip", "entry_id", "entry_name", "owner"},
+		nil,
+	),
+}
+
+func (ec *entryInfoCollector) Update(infos []EntryInfo) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	ec.infos = infos
+}
+
+func (ec *entryInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ec.desc
+}
+
+func (ec *entryInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	ec.mutex.RLock()
+	defer ec.mutex.RUnlock()
+	for _, info := range ec.infos {
+		ch <- prometheus.MustNewConstMetric(ec.desc, prometheus.GaugeValue, 1,
+			info.Hostname, info.IP, strconv.FormatUint(uint64(info.EntryID), 10), info.Name, info.Owner)
+	}
+}
@@ -0,0 +1,21 @@
+package pkg
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// 按源地址统计的流量,source_name来自-source-names,没有匹配时为空
+var (
+	SourcePackets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outputguard_source_packets_total",
+			Help: "Packets forwarded to whitelisted ips by internal source",
+		},
+		[]string{"hostname", "source", "source_name", "ip", "direction"},
+	)
+	SourceBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outputguard_source_bytes_total",
+			Help: "Bytes forwarded to whitelisted ips by internal source",
+		},
+		[]string{"hostname", "source", "source_name", "ip", "direction"},
+	)
+)
@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"sort"
+	"time"
+
+	"outputGuard/global"
+)
+
+// 规则删除后总量继续保留的时间,期间重新添加的规则从原来的总量继续累加
+const counterRetention = 24 * time.Hour
+
+/*
+ * CounterTotal 每个ip每个方向单调递增的流量总量
+ * 一个ip的计数由多条规则(协议/端口/源网段不同)或集合元素相加而来,按每条规则分别计算增量:
+ * 规则被删除后重新添加(重新渲染、修复漂移、重启)时计数归零,
+ * 本次计数小于上一次或上一次没有该规则时视为归零,把本次的计数整体累加
+ */
+type CounterTotal struct {
+	Hostname  string `json:"hostname"`
+	Ip        string `json:"ip"`
+	Direction string `json:"direction"`
+	// 上一次采集到的每条规则的计数
+	Rules map[string]RuleLast `json:"rules"`
+	// 累加后的总量
+	Packets  float64   `json:"packets"`
+	Bytes    float64   `json:"bytes"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type RuleLast struct {
+	Packets float64 `json:"packets"`
+	Bytes   float64 `json:"bytes"`
+}
+
+func totalKey(hostname, ip, direction string) string {
+	return hostname + "_" + direction + "_" + ip
+}
+
+// accumulate 调用方需持有mutex
+func (cs *CounterSnapshot) accumulate(data []global.ExporterData, now time.Time) {
+	seen := make(map[string]bool, len(data))
+	for _, ge := range data {
+		key := totalKey(ge.Hostname, ge.Ip, ge.Direction)
+		seen[key] = true
+		total, ok := cs.totals[key]
+		if !ok {
+			total = &CounterTotal{Hostname: ge.Hostname, Ip: ge.Ip, Direction: ge.Direction}
+			cs.totals[key] = total
+		}
+		// 只保留本次仍存在的规则,已删除的规则之后重新添加时从0开始计数
+		rules := make(map[string]RuleLast, len(ge.Rules))
+		for _, rule := range ge.Rules {
+			last := total.Rules[rule.Key]
+			if rule.Packets < last.Packets || rule.Bytes < last.Bytes {
+				last = RuleLast{}
+			}
+			total.Packets += rule.Packets - last.Packets
+			total.Bytes += rule.Bytes - last.Bytes
+			rules[rule.Key] = RuleLast{Packets: rule.Packets, Bytes: rule.Bytes}
+		}
+		total.Rules = rules
+		total.LastSeen = now
+	}
+	for key, total := range cs.totals {
+		if !seen[key] {
+			total.Rules = nil
+		}
+		if now.Sub(total.LastSeen) > counterRetention {
+			delete(cs.totals, key)
+		}
+	}
+}
+
+// Totals 按ip与方向排序,持久化的文件内容稳定
+func (cs *CounterSnapshot) Totals() []CounterTotal {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	totals := make([]CounterTotal, 0, len(cs.totals))
+	for _, total := range cs.totals {
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		return totalKey(totals[i].Hostname, totals[i].Ip, totals[i].Direction) < totalKey(totals[j].Hostname, totals[j].Ip, totals[j].Direction)
+	})
+	return totals
+}
+
+/*
+ * RestoreTotals 启动时恢复持久化的总量,需在第一次采集前调用
+ * 规则在gateway重启期间保留时,第一次采集只累加重启以来的增量
+ */
+func (cs *CounterSnapshot) RestoreTotals(totals []CounterTotal) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	for i := range totals {
+		total := totals[i]
+		cs.totals[totalKey(total.Hostname, total.Ip, total.Direction)] = &total
+	}
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// /api/v1 统一的错误码
+const (
+	CodeInvalidRequest  = "INVALID_REQUEST"
+	CodeInvalidTarget   = "INVALID_TARGET"
+	CodeEntryNotFound   = "ENTRY_NOT_FOUND"
+	CodeEntryExists     = "ENTRY_EXISTS"
+	CodeEntryProtected  = "ENTRY_PROTECTED"
+	CodeEntryNotPending = "ENTRY_NOT_PENDING"
+	CodeUnauthorized    = "UNAUTHORIZED"
+	CodeForbidden       = "FORBIDDEN"
+	CodeInternalError   = "INTERNAL_ERROR"
+)
+
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, code, format string, args ...interface{}) *APIError {
+	return &APIError{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// abortWithError 非APIError的错误一律按内部错误返回
+func abortWithError(ctx *gin.Context, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = newAPIError(http.StatusInternalServerError, CodeInternalError, "%s", err.Error())
+	}
+	ctx.AbortWithStatusJSON(apiErr.Status, gin.H{
+		"error": apiErr,
+	})
+}
@@ -0,0 +1,246 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"outputGuard/model/orm"
+
+	"github.com/gin-gonic/gin"
+)
+
+type createEntryRequest struct {
+	Name         string     `json:"name"`
+	Protocol     string     `json:"protocol"`
+	Ports        string     `json:"ports"`
+	Sources      []string   `json:"sources"`
+	NonDeletable bool       `json:"non_deletable"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	TTL          string     `json:"ttl"`
+	Reason       string     `json:"reason"`
+}
+
+type updateEntryRequest struct {
+	NonDeletable *bool      `json:"non_deletable"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	TTL          string     `json:"ttl"`
+	ClearExpiry  bool       `json:"clear_expiry"`
+	Reason       string     `json:"reason"`
+}
+
+type approveEntryRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (hs *HttpServer) registerV1(r *gin.Engine) {
+	v1 := r.Group("/api/v1")
+	v1.POST("/login", hs.Login)
+	v1.POST("/logout", hs.Logout)
+	v1.GET("/whoami", hs.Auth.Require(RoleViewer), hs.WhoAmI)
+
+	v1.GET("/entries", hs.Auth.Require(RoleViewer), hs.ListEntries)
+	v1.POST("/entries", hs.Auth.Require(RoleRequester), hs.CreateEntry)
+	v1.GET("/entries/:id", hs.Auth.Require(RoleViewer), hs.GetEntry)
+	v1.PATCH("/entries/:id", hs.Auth.Require(RoleApprover), hs.UpdateEntry)
+	v1.DELETE("/entries/:id", hs.Auth.Require(RoleApprover), hs.DeleteEntry)
+	v1.POST("/entries/:id/approve", hs.Auth.Require(RoleApprover), hs.ApproveEntry)
+	v1.POST("/entries/:id/extend", hs.Auth.Require(RoleRequester), hs.ExtendEntry)
+	v1.GET("/audits", hs.Auth.Require(RoleViewer), hs.ListAudits)
+	v1.GET("/gateways", hs.Auth.Require(RoleViewer), hs.ListGateways)
+	v1.GET("/blocked", hs.Auth.Require(RoleViewer), hs.ListBlocked)
+}
+
+// ListEntries 支持expiring_within参数,只返回该时长内将过期的条目
+func (hs *HttpServer) ListEntries(ctx *gin.Context) {
+	var deadline time.Time
+	if v := ctx.Query("expiring_within"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "无效的expiring_within:%s", v))
+			return
+		}
+		deadline = time.Now().Add(d)
+	}
+	entries, err := hs.WssServer.Orms.ListEntries()
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	views := make([]EntryView, 0, len(entries))
+	for i := range entries {
+		if !deadline.IsZero() && (entries[i].ExpiresAt == nil || entries[i].ExpiresAt.After(deadline)) {
+			continue
+		}
+		views = append(views, newEntryView(&entries[i]))
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"entries": views,
+	})
+}
+
+func (hs *HttpServer) CreateEntry(ctx *gin.Context) {
+	var req createEntryRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "请求体解析失败:%s", err.Error()))
+		return
+	}
+	expiresAt, err := parseExpiry(req.ExpiresAt, req.TTL, time.Now())
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	spec := EntrySpec{
+		Name:         req.Name,
+		Protocol:     req.Protocol,
+		Ports:        req.Ports,
+		Sources:      req.Sources,
+		NonDeletable: req.NonDeletable,
+		ExpiresAt:    expiresAt,
+	}
+	entry, results, err := hs.createEntry(spec, operatorFrom(ctx, req.Reason))
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	entry, err = hs.WssServer.Orms.GetEntry(entry.ID)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, gin.H{
+		"entry":   newEntryView(entry),
+		"results": results,
+	})
+}
+
+func (hs *HttpServer) GetEntry(ctx *gin.Context) {
+	entry, err := hs.entryFromPath(ctx)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"entry": newEntryView(entry),
+	})
+}
+
+func (hs *HttpServer) UpdateEntry(ctx *gin.Context) {
+	entry, err := hs.entryFromPath(ctx)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	var req updateEntryRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "请求体解析失败:%s", err.Error()))
+		return
+	}
+	op := operatorFrom(ctx, req.Reason)
+	if req.ClearExpiry || req.ExpiresAt != nil || req.TTL != "" {
+		var expiresAt *time.Time
+		if !req.ClearExpiry {
+			expiresAt, err = parseExpiry(req.ExpiresAt, req.TTL, time.Now())
+			if err != nil {
+				abortWithError(ctx, err)
+				return
+			}
+		}
+		if err := hs.WssServer.Orms.SetEntryExpiry(entry.ID, expiresAt); err != nil {
+			abortWithError(ctx, err)
+			return
+		}
+		hs.WssServer.auditWithReload(op, AuditUpdate, entry, nil, snapshotEntry(entry))
+	}
+	if req.NonDeletable != nil {
+		if entry.IsNoDel && !*req.NonDeletable && !op.Allowed(RoleAdmin) {
+			abortWithError(ctx, newAPIError(http.StatusForbidden, CodeForbidden, "只有admin可以取消条目%s的不可删除保护", entry.Name))
+			return
+		}
+		if err := hs.WssServer.Orms.UpdateEntryNoDel(entry.ID, *req.NonDeletable); err != nil {
+			abortWithError(ctx, err)
+			return
+		}
+		hs.WssServer.auditWithReload(op, AuditUpdate, entry, nil, snapshotEntry(entry))
+	}
+	entry, err = hs.WssServer.Orms.GetEntry(entry.ID)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"entry": newEntryView(entry),
+	})
+}
+
+func (hs *HttpServer) DeleteEntry(ctx *gin.Context) {
+	entry, err := hs.entryFromPath(ctx)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	op := operatorFrom(ctx, ctx.Query("reason"))
+	force := ctx.Query("force") == "true"
+	if force && !op.Allowed(RoleAdmin) {
+		abortWithError(ctx, newAPIError(http.StatusForbidden, CodeForbidden, "只有admin可以强制删除不可删除的条目"))
+		return
+	}
+	results, err := hs.deleteEntry(entry, force, op)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	remaining, err := hs.WssServer.Orms.GetEntry(entry.ID)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"deleted": remaining == nil,
+		"results": results,
+	})
+}
+
+func (hs *HttpServer) ApproveEntry(ctx *gin.Context) {
+	entry, err := hs.entryFromPath(ctx)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	var req approveEntryRequest
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "请求体解析失败:%s", err.Error()))
+			return
+		}
+	}
+	results, err := hs.approveEntry(entry, operatorFrom(ctx, req.Reason))
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	entry, err = hs.WssServer.Orms.GetEntry(entry.ID)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"entry":   newEntryView(entry),
+		"results": results,
+	})
+}
+
+func (hs *HttpServer) entryFromPath(ctx *gin.Context) (*orm.Entry, error) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "无效的条目id:%s", ctx.Param("id"))
+	}
+	entry, err := hs.WssServer.Orms.GetEntry(uint(id))
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, newAPIError(http.StatusNotFound, CodeEntryNotFound, "条目%d不存在", id)
+	}
+	return entry, nil
+}
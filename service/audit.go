@@ -0,0 +1,164 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "outputGuard/logger"
+	"outputGuard/model/orm"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 审计动作
+const (
+	AuditCreate  = "create"
+	AuditRequest = "request"
+	AuditApprove = "approve"
+	AuditUpdate  = "update"
+	AuditDelete  = "delete"
+	AuditAddIPs  = "add_ips"
+	AuditAutoAdd = "auto_add"
+)
+
+// Operator 操作者,用于权限判断与审计
+type Operator struct {
+	Identity
+	SourceIP string
+	Reason   string
+}
+
+// SystemOperator server内部任务使用的操作者
+func SystemOperator(name string) Operator {
+	return Operator{
+		Identity: Identity{Name: "system:" + name, Role: RoleAdmin},
+	}
+}
+
+func operatorFrom(ctx *gin.Context, reason string) Operator {
+	return Operator{
+		Identity: IdentityFrom(ctx),
+		SourceIP: ctx.ClientIP(),
+		Reason:   reason,
+	}
+}
+
+// snapshotEntry 审计中记录的条目状态,条目不存在时为空
+func snapshotEntry(entry *orm.Entry) string {
+	if entry == nil {
+		return ""
+	}
+	data, err := json.Marshal(newEntryView(entry))
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+/*
+ * 写审计记录
+ * 审计失败只记录日志,不影响白名单变更本身
+ */
+func (s *WssServer) audit(op Operator, action string, entry *orm.Entry, results []IPResult, before, after string) {
+	record := &orm.AuditLog{
+		Actor:     op.Name,
+		SourceIP:  op.SourceIP,
+		Action:    action,
+		Reason:    op.Reason,
+		Before:    before,
+		After:     after,
+		CreatedAt: time.Now().Local(),
+	}
+	if entry != nil {
+		record.EntryID = entry.ID
+		record.EntryName = entry.Name
+	}
+	if results != nil {
+		data, err := json.Marshal(results)
+		if err == nil {
+			record.IPs = string(data)
+		}
+	}
+	if err := s.Orms.AddAudit(record); err != nil {
+		Logger.Error(fmt.Sprintf("写入审计记录失败:%s,记录:%+v", err.Error(), record))
+	}
+}
+
+type AuditView struct {
+	ID        uint            `json:"id"`
+	Actor     string          `json:"actor"`
+	SourceIP  string          `json:"source_ip"`
+	Action    string          `json:"action"`
+	EntryID   uint            `json:"entry_id"`
+	EntryName string          `json:"entry_name"`
+	IPs       json.RawMessage `json:"ips,omitempty"`
+	Reason    string          `json:"reason"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return nil
+	}
+	return json.RawMessage(s)
+}
+
+func (hs *HttpServer) ListAudits(ctx *gin.Context) {
+	filter := orm.AuditFilter{
+		Actor:  ctx.Query("actor"),
+		Action: ctx.Query("action"),
+	}
+	if v := ctx.Query("entry_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "无效的entry_id:%s", v))
+			return
+		}
+		filter.EntryID = uint(id)
+	}
+	if v := ctx.Query("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "since需为RFC3339格式:%s", v))
+			return
+		}
+		filter.Since = since
+	}
+	if v := ctx.Query("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "无效的limit:%s", v))
+			return
+		}
+		filter.Limit = limit
+	}
+	records, err := hs.WssServer.Orms.QueryAudits(filter)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	views := make([]AuditView, 0, len(records))
+	for _, r := range records {
+		views = append(views, AuditView{
+			ID:        r.ID,
+			Actor:     r.Actor,
+			SourceIP:  r.SourceIP,
+			Action:    r.Action,
+			EntryID:   r.EntryID,
+			EntryName: r.EntryName,
+			IPs:       rawJSON(r.IPs),
+			Reason:    r.Reason,
+			Before:    rawJSON(r.Before),
+			After:     rawJSON(r.After),
+			CreatedAt: r.CreatedAt,
+		})
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"audits": views,
+	})
+}
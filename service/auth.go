@@ -0,0 +1,287 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"outputGuard/global"
+	. "outputGuard/logger"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+ * 角色由低到高:
+ * viewer 只读
+ * requester 可以提交白名单申请,申请需审批后才会下发
+ * approver 可以直接增删白名单并审批申请
+ * admin 可以删除不可删除(IsNoDel)的条目
+ */
+const (
+	RoleViewer    = "viewer"
+	RoleRequester = "requester"
+	RoleApprover  = "approver"
+	RoleAdmin     = "admin"
+)
+
+const (
+	sessionCookieName = "outputguard_session"
+	identityKey       = "identity"
+)
+
+var roleLevels = map[string]int{
+	RoleViewer:    1,
+	RoleRequester: 2,
+	RoleApprover:  3,
+	RoleAdmin:     4,
+}
+
+// Identity 请求的操作者
+type Identity struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+func (id Identity) Allowed(role string) bool {
+	return roleLevels[id.Role] >= roleLevels[role]
+}
+
+type session struct {
+	identity  Identity
+	expiresAt time.Time
+}
+
+type Authenticator struct {
+	conf     global.AuthConfig
+	sessions map[string]session
+	mutex    sync.Mutex
+	// 为true时gateway必须提供已校验的客户端证书
+	RequireGatewayCert bool
+}
+
+func NewAuthenticator(conf global.AuthConfig) *Authenticator {
+	if !conf.Enabled {
+		Logger.Warn("未开启认证,所有请求都以approver身份处理,任意主机都可以注册为gateway")
+	}
+	for _, user := range conf.Users {
+		if _, ok := roleLevels[user.Role]; !ok {
+			Logger.Panic(fmt.Sprintf("用户%s的角色%s无效", user.Username, user.Role))
+		}
+	}
+	for _, token := range conf.Tokens {
+		if _, ok := roleLevels[token.Role]; !ok {
+			Logger.Panic(fmt.Sprintf("token %s的角色%s无效", token.Name, token.Role))
+		}
+	}
+	return &Authenticator{
+		conf:     conf,
+		sessions: make(map[string]session),
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func tokenMatches(token, expectedSHA256 string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(strings.ToLower(expectedSHA256))) == 1
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// identify 依次尝试api token与页面session
+func (a *Authenticator) identify(ctx *gin.Context) (Identity, bool) {
+	if !a.conf.Enabled {
+		return Identity{Name: "anonymous", Role: RoleApprover}, true
+	}
+	if token := bearerToken(ctx.Request); token != "" {
+		for _, t := range a.conf.Tokens {
+			if tokenMatches(token, t.TokenSHA256) {
+				return Identity{Name: "token:" + t.Name, Role: t.Role}, true
+			}
+		}
+		return Identity{}, false
+	}
+	cookie, err := ctx.Cookie(sessionCookieName)
+	if err != nil || cookie == "" {
+		return Identity{}, false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	s, ok := a.sessions[cookie]
+	if !ok {
+		return Identity{}, false
+	}
+	if time.Now().After(s.expiresAt) {
+		delete(a.sessions, cookie)
+		return Identity{}, false
+	}
+	return s.identity, true
+}
+
+// Require 要求请求者至少具有role角色
+func (a *Authenticator) Require(role string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		identity, ok := a.identify(ctx)
+		if !ok {
+			abortWithError(ctx, newAPIError(http.StatusUnauthorized, CodeUnauthorized, "未登录或token无效"))
+			return
+		}
+		if !identity.Allowed(role) {
+			abortWithError(ctx, newAPIError(http.StatusForbidden, CodeForbidden, "%s没有%s权限", identity.Name, role))
+			return
+		}
+		ctx.Set(identityKey, identity)
+		ctx.Next()
+	}
+}
+
+// IdentityFrom 取出Require中间件写入的操作者
+func IdentityFrom(ctx *gin.Context) Identity {
+	if v, ok := ctx.Get(identityKey); ok {
+		return v.(Identity)
+	}
+	return Identity{Name: "anonymous"}
+}
+
+/*
+ * 校验gateway并返回其身份
+ * 提供了已校验的客户端证书时以证书中的名字为准,忽略自报的hostname
+ * 否则校验token,只有配置中登记的gateway可以注册
+ */
+func (a *Authenticator) AuthenticateGateway(hostname string, r *http.Request) (string, bool) {
+	if name := certIdentity(r); name != "" {
+		if hostname != "" && hostname != name {
+			Logger.Warn(fmt.Sprintf("gateway自报的hostname:%s与证书中的%s不一致,以证书为准", hostname, name))
+		}
+		return name, !a.conf.Enabled || a.gatewayRegistered(name)
+	}
+	if a.RequireGatewayCert {
+		return hostname, false
+	}
+	if !a.conf.Enabled {
+		return hostname, true
+	}
+	token := bearerToken(r)
+	if token == "" {
+		return hostname, false
+	}
+	for _, gw := range a.conf.Gateways {
+		if gw.Hostname == hostname && tokenMatches(token, gw.TokenSHA256) {
+			return hostname, true
+		}
+	}
+	return hostname, false
+}
+
+func (a *Authenticator) gatewayRegistered(name string) bool {
+	for _, gw := range a.conf.Gateways {
+		if gw.Hostname == name {
+			return true
+		}
+	}
+	return false
+}
+
+// certIdentity 已校验的客户端证书中的名字,优先使用CN,为空时使用第一个DNS SAN
+func certIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+func (a *Authenticator) Login(username, password string) (string, Identity, error) {
+	if !a.conf.Enabled {
+		return "", Identity{}, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "未开启认证")
+	}
+	for _, user := range a.conf.Users {
+		if user.Username != username {
+			continue
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+			break
+		}
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return "", Identity{}, err
+		}
+		sessionID := hex.EncodeToString(buf)
+		identity := Identity{Name: user.Username, Role: user.Role}
+		a.mutex.Lock()
+		a.sessions[sessionID] = session{identity: identity, expiresAt: time.Now().Add(a.conf.SessionTTL)}
+		a.mutex.Unlock()
+		return sessionID, identity, nil
+	}
+	return "", Identity{}, newAPIError(http.StatusUnauthorized, CodeUnauthorized, "用户名或密码错误")
+}
+
+func (a *Authenticator) Logout(ctx *gin.Context) {
+	cookie, err := ctx.Cookie(sessionCookieName)
+	if err != nil {
+		return
+	}
+	a.mutex.Lock()
+	delete(a.sessions, cookie)
+	a.mutex.Unlock()
+}
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (hs *HttpServer) Login(ctx *gin.Context) {
+	var req loginRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "请求体解析失败:%s", err.Error()))
+		return
+	}
+	sessionID, identity, err := hs.Auth.Login(req.Username, req.Password)
+	if err != nil {
+		Logger.Warn(fmt.Sprintf("用户%s登录失败,来源:%s", req.Username, ctx.ClientIP()))
+		abortWithError(ctx, err)
+		return
+	}
+	ctx.SetSameSite(http.SameSiteStrictMode)
+	ctx.SetCookie(sessionCookieName, sessionID, int(hs.Auth.conf.SessionTTL.Seconds()), "/", "", ctx.Request.TLS != nil, true)
+	ctx.JSON(http.StatusOK, gin.H{
+		"identity": identity,
+	})
+}
+
+func (hs *HttpServer) Logout(ctx *gin.Context) {
+	hs.Auth.Logout(ctx)
+	ctx.SetSameSite(http.SameSiteStrictMode)
+	ctx.SetCookie(sessionCookieName, "", -1, "/", "", ctx.Request.TLS != nil, true)
+	ctx.Status(http.StatusNoContent)
+}
+
+func (hs *HttpServer) WhoAmI(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"identity":     IdentityFrom(ctx),
+		"auth_enabled": hs.Auth.conf.Enabled,
+	})
+}
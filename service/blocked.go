@@ -0,0 +1,120 @@
+package service
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"outputGuard/global"
+
+	"github.com/gin-gonic/gin"
+)
+
+// server保留最近被拦截的连接,只在内存中,重启后清空
+const (
+	blockedRetention = 24 * time.Hour
+	maxBlockedFlows  = 5000
+)
+
+// BlockedView 所有gateway上报的同一来源/目的/协议/端口汇总在一起
+type BlockedView struct {
+	global.BlockedFlow
+	Gateways []string `json:"gateways"`
+}
+
+type blockedStore struct {
+	mutex sync.Mutex
+	flows map[string]*BlockedView
+}
+
+func newBlockedStore() *blockedStore {
+	return &blockedStore{flows: make(map[string]*BlockedView)}
+}
+
+func (bs *blockedStore) record(hostname string, flows []global.BlockedFlow) {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	for _, flow := range flows {
+		view, ok := bs.flows[flow.Key()]
+		if !ok {
+			bs.flows[flow.Key()] = &BlockedView{BlockedFlow: flow, Gateways: []string{hostname}}
+			continue
+		}
+		view.Count += flow.Count
+		if flow.LastSeen.After(view.LastSeen) {
+			view.LastSeen = flow.LastSeen
+		}
+		if !containsString(view.Gateways, hostname) {
+			view.Gateways = append(view.Gateways, hostname)
+		}
+	}
+	bs.expire(time.Now())
+}
+
+// expire 删除过期的连接,超过上限时删除最久没有被拦截的,调用方需持有mutex
+func (bs *blockedStore) expire(now time.Time) {
+	for key, view := range bs.flows {
+		if now.Sub(view.LastSeen) > blockedRetention {
+			delete(bs.flows, key)
+		}
+	}
+	if len(bs.flows) <= maxBlockedFlows {
+		return
+	}
+	views := bs.sorted()
+	for _, view := range views[maxBlockedFlows:] {
+		delete(bs.flows, view.Key())
+	}
+}
+
+// sorted 按最后一次被拦截的时间倒序,调用方需持有mutex
+func (bs *blockedStore) sorted() []BlockedView {
+	views := make([]BlockedView, 0, len(bs.flows))
+	for _, view := range bs.flows {
+		v := *view
+		v.Gateways = append([]string{}, view.Gateways...)
+		views = append(views, v)
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].LastSeen.After(views[j].LastSeen)
+	})
+	return views
+}
+
+func (bs *blockedStore) list(limit int) []BlockedView {
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+	bs.expire(time.Now())
+	views := bs.sorted()
+	if len(views) > limit {
+		views = views[:limit]
+	}
+	return views
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ListBlocked 最近被gateway拦截的连接,支持limit参数
+func (hs *HttpServer) ListBlocked(ctx *gin.Context) {
+	limit := 200
+	if v := ctx.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "无效的limit:%s", v))
+			return
+		}
+		limit = n
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"blocked": hs.WssServer.blocked.list(limit),
+	})
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"outputGuard/global"
+	. "outputGuard/logger"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+/*
+ * outputGuard的规则都在自有链中
+ * 内置链中只有跳转到自有链的规则,卸载时删除跳转与自有链即可恢复
+ * 白名单链以RETURN结束,drop在单独的链中,跳转追加在内置链末尾,主机已有的放行规则先于drop生效
+ */
+const chainPrefix = "OUTPUTGUARD-"
+
+type managedChain struct {
+	table   string
+	builtin string
+	// 自有链名去掉前缀的部分,也是chainRules的key
+	name string
+	// 跳转规则追加在内置链末尾,否则插入为第一条
+	trailing bool
+}
+
+var managedChains = []managedChain{
+	{"filter", "INPUT", "INPUT", false},
+	{"filter", "OUTPUT", "OUTPUT", false},
+	{"filter", "FORWARD", "FORWARD", false},
+	{"nat", "POSTROUTING", "POSTROUTING", false},
+	{"filter", "INPUT", "INPUT-DROP", true},
+	{"filter", "OUTPUT", "OUTPUT-DROP", true},
+}
+
+func ogChain(name string) string {
+	return chainPrefix + name
+}
+
+func ogJump(name string) []string {
+	return []string{"-j", ogChain(name)}
+}
+
+// EnsureChains 创建自有链与跳转规则
+func (ir IptableRules) EnsureChains() error {
+	for _, ipt := range ir.families() {
+		for _, c := range managedChains {
+			exists, err := ipt.ChainExists(c.table, ogChain(c.name))
+			if err != nil {
+				return err
+			}
+			if !exists {
+				if err := ipt.NewChain(c.table, ogChain(c.name)); err != nil {
+					return err
+				}
+			}
+			if err := ensureJump(ipt, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * ensureJump 跳转规则不存在时添加
+ * 已存在时不调整位置,其他工具在前面插入规则后不会反复移动
+ */
+func ensureJump(ipt *iptables.IPTables, c managedChain) error {
+	exists, err := jumpExists(ipt, c)
+	if err != nil || exists {
+		return err
+	}
+	if c.trailing {
+		return ipt.Append(c.table, c.builtin, ogJump(c.name)...)
+	}
+	return ipt.Insert(c.table, c.builtin, 1, ogJump(c.name)...)
+}
+
+// Uninstall 删除跳转规则与自有链,旧版本写在内置链中的规则由MigrateLegacy删除
+func (ir *IptableRules) Uninstall() error {
+	for _, ipt := range ir.families() {
+		if err := removeChains(ipt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * MigrateLegacy 从旧版本升级时删除旧版本直接写在内置链中的规则
+ * 只删除地址在addrs中的放行与MASQUERADE规则,addrs为本地保存的期望状态与内网网段
+ * Docker、kube-proxy与管理员添加的规则地址不在其中,不受影响
+ */
+func (ir *IptableRules) MigrateLegacy(addrs map[string]bool) error {
+	for _, ipt := range ir.families() {
+		for _, c := range managedChains {
+			if c.trailing {
+				continue
+			}
+			if err := removeLegacyRules(ipt, c.table, c.builtin, addrs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeChains 倒序删除,drop链先于白名单链删除
+func removeChains(ipt *iptables.IPTables) error {
+	for i := len(managedChains) - 1; i >= 0; i-- {
+		c := managedChains[i]
+		exists, err := ipt.ChainExists(c.table, ogChain(c.name))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if err := ipt.DeleteIfExists(c.table, c.builtin, ogJump(c.name)...); err != nil {
+			return err
+		}
+		if err := ipt.ClearAndDeleteChain(c.table, ogChain(c.name)); err != nil {
+			return err
+		}
+		Logger.Info(fmt.Sprintf("已删除%s表的%s链", c.table, ogChain(c.name)))
+	}
+	return nil
+}
+
+/*
+ * removeLegacyRules 删除旧版本AddAccept/AddForwordRule/AddMasqueradeRule/AddDropAll写在内置链中的规则
+ * 先删除drop,避免放行规则已删除而drop仍生效
+ */
+func removeLegacyRules(ipt *iptables.IPTables, table, builtin string, addrs map[string]bool) error {
+	rules, err := ipt.List(table, builtin)
+	if err != nil {
+		return err
+	}
+	var drops, accepts [][]string
+	for _, rule := range rules {
+		parts := strings.Fields(rule)
+		if len(parts) < 3 || parts[0] != "-A" || !isLegacyRule(builtin, parts[2:], addrs) {
+			continue
+		}
+		if strings.Join(parts[2:], " ") == "-j DROP" {
+			drops = append(drops, parts[2:])
+			continue
+		}
+		accepts = append(accepts, parts[2:])
+	}
+	for _, spec := range append(drops, accepts...) {
+		if err := ipt.Delete(table, builtin, spec...); err != nil {
+			return fmt.Errorf("删除%s表%s链中旧版本的规则%s失败:%v", table, builtin, strings.Join(spec, " "), err)
+		}
+		Logger.Info(fmt.Sprintf("已删除%s表%s链中旧版本的规则:%s", table, builtin, strings.Join(spec, " ")))
+	}
+	return nil
+}
+
+/*
+ * isLegacyRule 旧版本的规则形如:
+ * INPUT/OUTPUT: -s IP -j ACCEPT、-j DROP、-p ipv6-icmp -j ACCEPT
+ * INPUT/FORWARD: -s IP [-p tcp [-m multiport --sports 443]] -j ACCEPT
+ * OUTPUT/FORWARD: -d IP [-p tcp [-m multiport --dports 443]] -j ACCEPT
+ * POSTROUTING: -d IP [-p tcp [-m multiport --dports 443]] -j MASQUERADE,-s 0.0.0.0/0在列出时被省略
+ * 带地址的规则只有地址在addrs中时才视为旧版本的规则
+ */
+func isLegacyRule(builtin string, spec []string, addrs map[string]bool) bool {
+	switch strings.Join(spec, " ") {
+	case "-j DROP", "-p ipv6-icmp -j ACCEPT":
+		return builtin == "INPUT" || builtin == "OUTPUT"
+	}
+	target := "ACCEPT"
+	if builtin == "POSTROUTING" {
+		target = "MASQUERADE"
+	}
+	if len(spec) < 4 || spec[len(spec)-2] != "-j" || spec[len(spec)-1] != target {
+		return false
+	}
+	switch {
+	case spec[0] == "-s" && builtin != "POSTROUTING":
+	case spec[0] == "-d" && builtin != "INPUT":
+	default:
+		return false
+	}
+	if _, _, err := net.ParseCIDR(spec[1]); err != nil || !addrs[global.CanonicalAddr(spec[1])] {
+		return false
+	}
+	match := spec[2 : len(spec)-2]
+	if len(match) == 0 {
+		return true
+	}
+	if len(match) < 2 || match[0] != "-p" {
+		return false
+	}
+	match = match[2:]
+	return len(match) == 0 || (len(match) == 4 && match[0] == "-m" && match[1] == "multiport" && (match[2] == "--sports" || match[2] == "--dports"))
+}
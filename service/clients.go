@@ -30,3 +30,35 @@ func (cs *ClientService) CheckIPForwarding() error {
 	}
 	return nil
 }
+
+// CheckIPv6Forwarding 检查内核参数 net.ipv6.conf.all.forwarding,未开启时IPv6无法转发
+func (cs *ClientService) CheckIPv6Forwarding() error {
+	cmd := exec.Command("sysctl", "net.ipv6.conf.all.forwarding")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("执行 sysctl 命令时发生错误: %v", err)
+	}
+
+	if strings.TrimSpace(out.String()) != "net.ipv6.conf.all.forwarding = 1" {
+		return fmt.Errorf("内核参数 net.ipv6.conf.all.forwarding 未开启, 当前值为: %s", out.String())
+	}
+	return nil
+}
+
+// CheckConntrackAccounting 检查内核参数 net.netfilter.nf_conntrack_acct,未开启时conntrack中没有流量计数
+func (cs *ClientService) CheckConntrackAccounting() error {
+	cmd := exec.Command("sysctl", "net.netfilter.nf_conntrack_acct")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("执行 sysctl 命令时发生错误: %v", err)
+	}
+
+	if strings.TrimSpace(out.String()) != "net.netfilter.nf_conntrack_acct = 1" {
+		return fmt.Errorf("内核参数 net.netfilter.nf_conntrack_acct 未开启, 当前值为: %s", out.String())
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+/*
+ * 按源地址统计经gateway出网的流量
+ * FORWARD链的计数器只能按白名单地址统计,源地址来自conntrack中做过SNAT的连接
+ * conntrack只保留存活的连接,每次采集与上一次的计数相减得到增量,累加后为单调递增的计数
+ * 两次采集之间建立并关闭的连接不会被统计,需要开启内核参数 net.netfilter.nf_conntrack_acct
+ */
+type ConntrackAccounting struct {
+	families []string
+	// 连接 -> 上一次采集时的计数,只在采集的goroutine中访问
+	flows map[string]conntrackFlow
+}
+
+// SourceTraffic 一次采集中某个源地址访问某个白名单地址的流量增量
+type SourceTraffic struct {
+	Source    string
+	Ip        string
+	Direction string
+	Packets   float64
+	Bytes     float64
+}
+
+// conntrackFlow 一条连接,orig为源地址->白名单地址,reply为回包
+type conntrackFlow struct {
+	source, ip               string
+	origPackets, origBytes   float64
+	replyPackets, replyBytes float64
+}
+
+func NewConntrackAccounting(ipv6 bool) (*ConntrackAccounting, error) {
+	if _, err := exec.LookPath("conntrack"); err != nil {
+		return nil, fmt.Errorf("未找到conntrack命令:%v", err)
+	}
+	ca := &ConntrackAccounting{families: []string{"ipv4"}, flows: make(map[string]conntrackFlow)}
+	if ipv6 {
+		ca.families = append(ca.families, "ipv6")
+	}
+	return ca, nil
+}
+
+/*
+ * Poll 返回每个(源地址,白名单地址,方向)自上一次采集以来的增量
+ * 仍然存活但没有新流量的连接也会返回增量为0的记录
+ */
+func (ca *ConntrackAccounting) Poll() ([]SourceTraffic, error) {
+	flows := make(map[string]conntrackFlow, len(ca.flows))
+	for _, family := range ca.families {
+		out, err := conntrackOutput("-L", "--src-nat", "-f", family)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(out))
+		for scanner.Scan() {
+			key, flow, ok := parseConntrack(scanner.Text())
+			if ok {
+				flows[key] = flow
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	totals := make(map[string]*SourceTraffic)
+	add := func(flow conntrackFlow, direction string, packets, bytes float64) {
+		key := flow.source + "_" + flow.ip + "_" + direction
+		t, ok := totals[key]
+		if !ok {
+			t = &SourceTraffic{Source: flow.source, Ip: flow.ip, Direction: direction}
+			totals[key] = t
+		}
+		t.Packets += packets
+		t.Bytes += bytes
+	}
+	for key, flow := range flows {
+		last, ok := ca.flows[key]
+		// 计数比上一次小说明是复用了同一个五元组的新连接
+		if !ok || flow.origBytes < last.origBytes || flow.replyBytes < last.replyBytes {
+			last = conntrackFlow{}
+		}
+		add(flow, "OUTPUT", flow.origPackets-last.origPackets, flow.origBytes-last.origBytes)
+		add(flow, "INPUT", flow.replyPackets-last.replyPackets, flow.replyBytes-last.replyBytes)
+	}
+	ca.flows = flows
+
+	result := make([]SourceTraffic, 0, len(totals))
+	for _, t := range totals {
+		result = append(result, *t)
+	}
+	return result, nil
+}
+
+/*
+ * 解析 conntrack -L 输出的一条连接,格式如:
+ * tcp 6 431999 ESTABLISHED src=10.0.0.5 dst=1.2.3.4 sport=5000 dport=443 packets=10 bytes=1000 src=1.2.3.4 dst=192.168.1.1 sport=443 dport=5000 packets=8 bytes=5000 [ASSURED] mark=0 use=1
+ * 第一组src/dst为原始方向,第二组为回包方向,key由协议与原始方向的地址/端口组成
+ */
+func parseConntrack(line string) (string, conntrackFlow, bool) {
+	var flow conntrackFlow
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return "", flow, false
+	}
+	key := []string{parts[0]}
+	tuple := -1
+	for _, part := range parts[1:] {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		if name == "src" {
+			tuple++
+		}
+		if tuple < 0 || tuple > 1 {
+			continue
+		}
+		switch name {
+		case "src":
+			if tuple == 0 {
+				flow.source = value
+			}
+		case "dst":
+			if tuple == 0 {
+				flow.ip = value
+			}
+		case "packets", "bytes":
+			v, ok := toFloat64(value)
+			if !ok {
+				return "", flow, false
+			}
+			switch {
+			case tuple == 0 && name == "packets":
+				flow.origPackets = v
+			case tuple == 0:
+				flow.origBytes = v
+			case name == "packets":
+				flow.replyPackets = v
+			default:
+				flow.replyBytes = v
+			}
+			continue
+		}
+		if tuple == 0 {
+			key = append(key, part)
+		}
+	}
+	if flow.source == "" || flow.ip == "" {
+		return "", flow, false
+	}
+	return strings.Join(key, " "), flow, true
+}
+
+func conntrackOutput(args ...string) ([]byte, error) {
+	cmd := exec.Command("conntrack", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("conntrack %s失败:%v:%s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"outputGuard/global"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Drift 实际规则与期望状态的差异
+type Drift struct {
+	// 期望存在但实际缺失的规则
+	Missing []global.Messages
+	// 不在期望状态中的规则
+	Unexpected []global.Messages
+	// 链、跳转规则或链中规则的顺序与期望不一致
+	Structure []string
+}
+
+func (d Drift) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Unexpected) == 0 && len(d.Structure) == 0
+}
+
+// diffMessages 按Key比较期望状态与实际规则
+func diffMessages(desired, live []global.Messages) Drift {
+	var drift Drift
+	liveKeys := make(map[string]bool, len(live))
+	for _, m := range live {
+		liveKeys[m.Key()] = true
+	}
+	desiredKeys := make(map[string]bool, len(desired))
+	for _, m := range desired {
+		desiredKeys[m.Key()] = true
+		if !liveKeys[m.Key()] {
+			drift.Missing = append(drift.Missing, m)
+		}
+	}
+	for _, m := range live {
+		if !desiredKeys[m.Key()] {
+			drift.Unexpected = append(drift.Unexpected, m)
+		}
+	}
+	sortMessages(drift.Missing)
+	sortMessages(drift.Unexpected)
+	return drift
+}
+
+func sortMessages(messages []global.Messages) {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Key() < messages[j].Key()
+	})
+}
+
+func familyName(ipt *iptables.IPTables) string {
+	if ipt.Proto() == iptables.ProtocolIPv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+/*
+ * verifyChains 检查跳转规则是否存在,自有链的内容与顺序是否与期望一致
+ * 不检查跳转规则的位置,其他工具在内置链中插入规则不视为漂移
+ * 规则按ruleKey比较,与iptables输出的地址格式和参数顺序无关
+ */
+func (ir IptableRules) verifyChains(expected map[*iptables.IPTables]chainRules) ([]string, error) {
+	var structure []string
+	for _, ipt := range ir.families() {
+		family := familyName(ipt)
+		for _, c := range managedChains {
+			chain := ogChain(c.name)
+			jumped, err := jumpExists(ipt, c)
+			if err != nil {
+				return nil, err
+			}
+			if !jumped {
+				structure = append(structure, fmt.Sprintf("%s %s链中没有跳转到%s的规则", family, c.builtin, chain))
+			}
+			exists, err := ipt.ChainExists(c.table, chain)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				structure = append(structure, fmt.Sprintf("%s %s链不存在", family, chain))
+				continue
+			}
+			rules, err := ipt.List(c.table, chain)
+			if err != nil {
+				return nil, err
+			}
+			live := make([]string, 0, len(rules))
+			for _, rule := range rules {
+				parts := strings.Fields(rule)
+				if len(parts) < 2 || parts[0] != "-A" {
+					continue
+				}
+				live = append(live, ruleKey(parts[2:]))
+			}
+			want := expected[ipt][c.name]
+			if !sameRules(want, live) {
+				structure = append(structure, fmt.Sprintf("%s %s链的规则与期望不一致,期望%d条,实际%d条", family, chain, len(want), len(live)))
+			}
+		}
+	}
+	return structure, nil
+}
+
+func sameRules(want [][]string, live []string) bool {
+	if len(want) != len(live) {
+		return false
+	}
+	for i, spec := range want {
+		if ruleKey(spec) != live[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// jumpExists 内置链中是否有跳转到自有链的规则,自有链被删除时iptables -C会报错,因此列出后比较
+func jumpExists(ipt *iptables.IPTables, c managedChain) (bool, error) {
+	rules, err := ipt.List(c.table, c.builtin)
+	if err != nil {
+		return false, err
+	}
+	jump := fmt.Sprintf("-A %s %s", c.builtin, strings.Join(ogJump(c.name), " "))
+	for _, rule := range rules {
+		if rule == jump {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"outputGuard/global"
+	. "outputGuard/logger"
+	"outputGuard/model/orm"
+)
+
+// 单个ip的处理状态
+const (
+	IPStatusAdded     = "added"
+	IPStatusExists    = "exists"
+	IPStatusDeleted   = "deleted"
+	IPStatusProtected = "protected"
+	IPStatusFailed    = "failed"
+)
+
+// IPResult 条目下单个ip的处理结果
+type IPResult struct {
+	IP         string `json:"ip"`
+	IsLocalNet bool   `json:"is_local_net"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// EntrySpec 新建条目的参数
+type EntrySpec struct {
+	Name         string
+	Protocol     string
+	Ports        string
+	Sources      []string
+	NonDeletable bool
+	ExpiresAt    *time.Time
+}
+
+type EntryIPView struct {
+	IP           string    `json:"ip"`
+	IsLocalNet   bool      `json:"is_local_net"`
+	NonDeletable bool      `json:"non_deletable"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type EntryView struct {
+	ID           uint          `json:"id"`
+	Name         string        `json:"name"`
+	Type         string        `json:"type"`
+	NonDeletable bool          `json:"non_deletable"`
+	Protocol     string        `json:"protocol"`
+	Ports        string        `json:"ports"`
+	Sources      []string      `json:"sources"` // 为空表示所有经过gateway的机器都可以访问
+	Status       string        `json:"status"`
+	Owner        string        `json:"owner"`
+	ExpiresAt    *time.Time    `json:"expires_at"`
+	CreatedAt    time.Time     `json:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+	IPs          []EntryIPView `json:"ips"`
+}
+
+func newEntryView(entry *orm.Entry) EntryView {
+	view := EntryView{
+		ID:           entry.ID,
+		Name:         entry.Name,
+		Type:         entry.Types,
+		NonDeletable: entry.IsNoDel,
+		Protocol:     entry.Protocol,
+		Ports:        entry.Ports,
+		Sources:      global.SplitSources(entry.Sources),
+		Status:       entry.Status,
+		Owner:        entry.Owner,
+		ExpiresAt:    entry.ExpiresAt,
+		CreatedAt:    entry.CreatedAt,
+		UpdatedAt:    entry.UpdatedAt,
+		IPs:          make([]EntryIPView, 0, len(entry.IPs)),
+	}
+	for _, ip := range entry.IPs {
+		view.IPs = append(view.IPs, EntryIPView{
+			IP:           ip.IP,
+			IsLocalNet:   ip.IsLocalNet,
+			NonDeletable: ip.IsNoDel,
+			CreatedAt:    ip.CreatedAt,
+		})
+	}
+	return view
+}
+
+/*
+ * 解析域名/IP/网段并创建条目
+ * 同名条目已存在时返回ENTRY_EXISTS
+ * requester创建的条目为pending状态,审批通过后才会写入ip并下发
+ */
+func (hs *HttpServer) createEntry(spec EntrySpec, op Operator) (*orm.Entry, []IPResult, error) {
+	name := strings.TrimSpace(spec.Name)
+	if name == "" {
+		return nil, nil, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "name不能为空")
+	}
+	protocol, ports, err := global.NormalizePortSpec(spec.Protocol, spec.Ports)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "%s", err.Error())
+	}
+	sources, err := global.NormalizeSources(spec.Sources)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "%s", err.Error())
+	}
+	result, err := hs.Ss.ServerAction(name)
+	if err != nil {
+		return nil, nil, newAPIError(http.StatusBadRequest, CodeInvalidTarget, "解析%s失败:%s", name, err.Error())
+	}
+	existing, err := hs.WssServer.Orms.GetEntryByTarget(result.Name, protocol, ports, sources)
+	if err != nil {
+		return nil, nil, err
+	}
+	if existing != nil {
+		return nil, nil, newAPIError(http.StatusConflict, CodeEntryExists, "条目%s已存在,id为%d", result.Name, existing.ID)
+	}
+
+	entry := &orm.Entry{
+		Types:     result.Type,
+		Name:      result.Name,
+		IsNoDel:   spec.NonDeletable,
+		Protocol:  protocol,
+		Ports:     ports,
+		Sources:   sources,
+		Status:    orm.EntryStatusActive,
+		Owner:     op.Name,
+		ExpiresAt: spec.ExpiresAt,
+		CreatedAt: time.Now().Local(),
+	}
+	if !op.Allowed(RoleApprover) {
+		entry.Status = orm.EntryStatusPending
+	}
+	if err := hs.WssServer.Orms.CreateEntry(entry); err != nil {
+		return nil, nil, err
+	}
+	if entry.Status == orm.EntryStatusPending {
+		Logger.Info(fmt.Sprintf("%s提交了条目%s的申请,等待审批", op.Name, entry.Name))
+		hs.WssServer.audit(op, AuditRequest, entry, nil, "", snapshotEntry(entry))
+		return entry, []IPResult{}, nil
+	}
+	results := hs.WssServer.addEntryIPs(entry, result.IP)
+	hs.WssServer.auditWithReload(op, AuditCreate, entry, results, "")
+	return entry, results, nil
+}
+
+// approveEntry 审批时重新解析,写入ip并下发
+func (hs *HttpServer) approveEntry(entry *orm.Entry, op Operator) ([]IPResult, error) {
+	if entry.Status != orm.EntryStatusPending {
+		return nil, newAPIError(http.StatusConflict, CodeEntryNotPending, "条目%s不是待审批状态", entry.Name)
+	}
+	result, err := hs.Ss.ServerAction(entry.Name)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, CodeInvalidTarget, "解析%s失败:%s", entry.Name, err.Error())
+	}
+	if err := hs.WssServer.Orms.UpdateEntryStatus(entry.ID, orm.EntryStatusActive); err != nil {
+		return nil, err
+	}
+	before := snapshotEntry(entry)
+	results := hs.WssServer.addEntryIPs(entry, result.IP)
+	hs.WssServer.auditWithReload(op, AuditApprove, entry, results, before)
+	return results, nil
+}
+
+/*
+ * 删除条目下所有可删除的ip
+ * 仅当ip不再被其他条目引用时才通知gateway删除
+ * 内网ip等不可删除的ip会保留,此时条目本身也会保留
+ * force为true时忽略不可删除保护,只允许admin使用
+ */
+func (hs *HttpServer) deleteEntry(entry *orm.Entry, force bool, op Operator) ([]IPResult, error) {
+	if entry.IsNoDel && !force {
+		return nil, newAPIError(http.StatusConflict, CodeEntryProtected, "条目%s不可删除", entry.Name)
+	}
+	results, err := hs.removeEntryIPs(entry, force)
+	if err != nil {
+		return results, err
+	}
+	hs.WssServer.auditWithReload(op, AuditDelete, entry, results, snapshotEntry(entry))
+	return results, nil
+}
+
+// removeEntryIPs 删除条目下的ip,全部删除后删除条目本身
+func (hs *HttpServer) removeEntryIPs(entry *orm.Entry, force bool) ([]IPResult, error) {
+	results := make([]IPResult, 0, len(entry.IPs))
+	remaining := 0
+	for _, row := range entry.IPs {
+		res := IPResult{IP: row.IP, IsLocalNet: row.IsLocalNet}
+		if row.IsNoDel && !force {
+			res.Status = IPStatusProtected
+			remaining++
+			results = append(results, res)
+			continue
+		}
+		if err := hs.WssServer.Orms.DelEntryIP(entry.ID, row.IP); err != nil {
+			Logger.Error(fmt.Sprintf("删除%s的ip %s 失败: %s", entry.Name, row.IP, err.Error()))
+			res.Status = IPStatusFailed
+			res.Error = err.Error()
+			remaining++
+			results = append(results, res)
+			continue
+		}
+		res.Status = IPStatusDeleted
+		if err := hs.WssServer.unpublishIfUnused(row); err != nil {
+			res.Status = IPStatusFailed
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	if remaining == 0 {
+		if err := hs.WssServer.Orms.DeleteEntry(entry.ID); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// auditWithReload 重新查询条目作为变更后的状态写审计
+func (s *WssServer) auditWithReload(op Operator, action string, entry *orm.Entry, results []IPResult, before string) {
+	after, err := s.Orms.GetEntry(entry.ID)
+	if err != nil {
+		Logger.Error(fmt.Sprintf("查询条目%s失败:%s", entry.Name, err.Error()))
+	}
+	s.audit(op, action, entry, results, before, snapshotEntry(after))
+}
+
+// addEntryIPs 把ip写入条目,新写入的ip发布给gateway
+func (s *WssServer) addEntryIPs(entry *orm.Entry, ips []string) []IPResult {
+	results := make([]IPResult, 0, len(ips))
+	for _, ip := range ips {
+		isLocal, err := isPrivateIP(ip)
+		if err != nil {
+			Logger.Error(fmt.Sprintf("isPrivateIP:解析%s失败:%s", ip, err.Error()))
+		}
+		res := IPResult{IP: ip, IsLocalNet: isLocal}
+		// 内网ip强制设置为不可删除
+		created, err := s.Orms.AddEntryIP(entry, ip, entry.IsNoDel || isLocal, isLocal)
+		if err != nil {
+			Logger.Error(fmt.Sprintf("添加%s的ip %s 失败: %s", entry.Name, ip, err.Error()))
+			res.Status = IPStatusFailed
+			res.Error = err.Error()
+			results = append(results, res)
+			continue
+		}
+		if !created {
+			res.Status = IPStatusExists
+			results = append(results, res)
+			continue
+		}
+		res.Status = IPStatusAdded
+		message := global.Messages{
+			IP:         ip,
+			Action:     "add",
+			IsLocalNet: isLocal,
+			Protocol:   entry.Protocol,
+			Ports:      entry.Ports,
+			Sources:    entry.Sources,
+			Entries:    s.entryRefs(ip, entry.Protocol, entry.Ports, entry.Sources, entry),
+		}
+		if err := s.Publish(message); err != nil {
+			res.Status = IPStatusFailed
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+func entryRef(entry *orm.Entry) global.EntryRef {
+	return global.EntryRef{ID: entry.ID, Name: entry.Name, Owner: entry.Owner}
+}
+
+/*
+ * entryRefs 引用同一条规则的所有条目,gateway收到add时以此替换之前的条目
+ * 查询失败时至少带上当前条目
+ */
+func (s *WssServer) entryRefs(ip, protocol, ports, sources string, current *orm.Entry) []global.EntryRef {
+	entries, err := s.Orms.EntryRefsFor(ip, protocol, ports, sources)
+	if err != nil {
+		Logger.Error(fmt.Sprintf("查询引用ip %s 的条目失败:%s", ip, err.Error()))
+	}
+	refs := make([]global.EntryRef, 0, len(entries)+1)
+	for i := range entries {
+		refs = append(refs, entryRef(&entries[i]))
+	}
+	if current != nil {
+		refs = global.MergeEntries(refs, []global.EntryRef{entryRef(current)})
+	}
+	return refs
+}
+
+/*
+ * unpublishIfUnused ip没有被任何条目引用时通知gateway删除
+ * 仍被其他条目引用时下发剩余的条目,gateway据此更新ip所属的条目
+ */
+func (s *WssServer) unpublishIfUnused(row orm.CrawlerProxy) error {
+	refs, err := s.Orms.IPRefCount(row.IP, row.Protocol, row.Ports, row.Sources)
+	if err != nil {
+		return err
+	}
+	if refs > 0 {
+		Logger.Info(fmt.Sprintf("ip %s 仍被%d个条目引用,不通知gateway删除,只更新所属的条目", row.IP, refs))
+		return s.Publish(global.Messages{
+			IP:         row.IP,
+			Action:     global.ActionAdd,
+			IsLocalNet: row.IsLocalNet,
+			Protocol:   row.Protocol,
+			Ports:      row.Ports,
+			Sources:    row.Sources,
+			Entries:    s.entryRefs(row.IP, row.Protocol, row.Ports, row.Sources, nil),
+		})
+	}
+	return s.Publish(global.Messages{
+		IP:         row.IP,
+		Action:     "del",
+		IsLocalNet: row.IsLocalNet,
+		Protocol:   row.Protocol,
+		Ports:      row.Ports,
+		Sources:    row.Sources,
+	})
+}
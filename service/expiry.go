@@ -0,0 +1,196 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	. "outputGuard/logger"
+	"outputGuard/model/orm"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	AuditExtend        = "extend"
+	AuditExpire        = "expire"
+	AuditExpiryWarning = "expiry_warning"
+)
+
+type extendEntryRequest struct {
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL       string     `json:"ttl"`
+	Reason    string     `json:"reason"`
+}
+
+// parseExpiry expires_at与ttl二选一,都为空时返回nil
+func parseExpiry(expiresAt *time.Time, ttl string, base time.Time) (*time.Time, error) {
+	if expiresAt != nil && ttl != "" {
+		return nil, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "expires_at与ttl只能指定一个")
+	}
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "无效的ttl:%s", ttl)
+		}
+		t := base.Add(d)
+		return &t, nil
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return nil, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "expires_at需晚于当前时间")
+	}
+	return expiresAt, nil
+}
+
+/*
+ * 延长过期时间
+ * ttl从当前过期时间开始累加,已过期或未设置过期时间时从现在开始计算
+ * 条目的创建人可以延长自己的条目
+ */
+func (hs *HttpServer) ExtendEntry(ctx *gin.Context) {
+	entry, err := hs.entryFromPath(ctx)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	var req extendEntryRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "请求体解析失败:%s", err.Error()))
+		return
+	}
+	op := operatorFrom(ctx, req.Reason)
+	if !op.Allowed(RoleApprover) && entry.Owner != op.Name {
+		abortWithError(ctx, newAPIError(http.StatusForbidden, CodeForbidden, "%s不是条目%s的创建人", op.Name, entry.Name))
+		return
+	}
+	if entry.ExpiresAt == nil && req.TTL == "" && req.ExpiresAt == nil {
+		abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "需指定expires_at或ttl"))
+		return
+	}
+	base := time.Now()
+	if entry.ExpiresAt != nil && entry.ExpiresAt.After(base) {
+		base = *entry.ExpiresAt
+	}
+	expiresAt, err := parseExpiry(req.ExpiresAt, req.TTL, base)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	if expiresAt == nil {
+		abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "需指定expires_at或ttl"))
+		return
+	}
+	// 只能延长,缩短过期时间需通过PATCH由approver修改
+	if entry.ExpiresAt != nil && expiresAt.Before(*entry.ExpiresAt) {
+		abortWithError(ctx, newAPIError(http.StatusBadRequest, CodeInvalidRequest, "expires_at不能早于当前的过期时间%s", entry.ExpiresAt.Local().Format(time.DateTime)))
+		return
+	}
+	if err := hs.WssServer.Orms.SetEntryExpiry(entry.ID, expiresAt); err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	// 延长后重新参与过期检查,域名条目会重新解析
+	if entry.Status == orm.EntryStatusExpired {
+		if err := hs.WssServer.Orms.UpdateEntryStatus(entry.ID, orm.EntryStatusActive); err != nil {
+			abortWithError(ctx, err)
+			return
+		}
+	}
+	hs.WssServer.auditWithReload(op, AuditExtend, entry, nil, snapshotEntry(entry))
+	entry, err = hs.WssServer.Orms.GetEntry(entry.ID)
+	if err != nil {
+		abortWithError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"entry": newEntryView(entry),
+	})
+}
+
+/*
+ * 定期检查过期条目
+ * 已过期的条目按普通删除流程处理,通知gateway删除
+ * 即将过期的条目只提醒一次,延长过期时间后会重新提醒
+ */
+func (hs *HttpServer) RunExpiryReaper(interval, warnBefore time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		hs.warnExpiringEntries(warnBefore)
+		hs.reapExpiredEntries()
+	}
+}
+
+func (hs *HttpServer) warnExpiringEntries(warnBefore time.Duration) {
+	now := time.Now()
+	entries, err := hs.WssServer.Orms.QueryExpiringEntries(now.Add(warnBefore))
+	if err != nil {
+		Logger.Error(fmt.Sprintf("查询即将过期的条目失败:%s", err.Error()))
+		return
+	}
+	op := SystemOperator("expiry-reaper")
+	for i := range entries {
+		entry := &entries[i]
+		Logger.Warn(fmt.Sprintf("条目%s(#%d,创建人:%s)将于%s过期", entry.Name, entry.ID, entry.Owner, entry.ExpiresAt.Local().Format(time.DateTime)))
+		if err := hs.WssServer.Orms.MarkExpiryWarned(entry.ID, now); err != nil {
+			Logger.Error(fmt.Sprintf("标记条目%s已提醒失败:%s", entry.Name, err.Error()))
+			continue
+		}
+		op.Reason = fmt.Sprintf("将于%s过期", entry.ExpiresAt.Local().Format(time.DateTime))
+		hs.WssServer.audit(op, AuditExpiryWarning, entry, nil, "", "")
+	}
+}
+
+func (hs *HttpServer) reapExpiredEntries() {
+	entries, err := hs.WssServer.Orms.QueryExpiredEntries(time.Now())
+	if err != nil {
+		Logger.Error(fmt.Sprintf("查询已过期的条目失败:%s", err.Error()))
+		return
+	}
+	for i := range entries {
+		entry := &entries[i]
+		op := SystemOperator("expiry-reaper")
+		op.Reason = fmt.Sprintf("已于%s过期", entry.ExpiresAt.Local().Format(time.DateTime))
+		results, err := hs.expireEntry(entry, op)
+		if err != nil {
+			Logger.Error(fmt.Sprintf("删除过期条目%s失败:%s", entry.Name, err.Error()))
+			continue
+		}
+		Logger.Info(fmt.Sprintf("过期条目%s已处理,结果:%+v", entry.Name, results))
+	}
+}
+
+/*
+ * expireEntry 与deleteEntry相同,但审计动作记录为expire
+ * 只剩不可删除的ip时条目标记为expired,不再重复处理
+ * 有ip删除失败时保留过期状态,下次检查时重试
+ * 没有任何ip被删除时不写审计,避免每次检查都重复记录
+ */
+func (hs *HttpServer) expireEntry(entry *orm.Entry, op Operator) ([]IPResult, error) {
+	results, err := hs.removeEntryIPs(entry, false)
+	if err != nil {
+		return results, err
+	}
+	changed, failed, remaining := len(entry.IPs) == 0, false, 0
+	for _, res := range results {
+		switch res.Status {
+		case IPStatusDeleted:
+			changed = true
+		case IPStatusFailed:
+			failed = true
+			remaining++
+		case IPStatusProtected:
+			remaining++
+		}
+	}
+	if remaining > 0 && !failed {
+		if err := hs.WssServer.Orms.UpdateEntryStatus(entry.ID, orm.EntryStatusExpired); err != nil {
+			return results, err
+		}
+		changed = true
+	}
+	if changed {
+		hs.WssServer.auditWithReload(op, AuditExpire, entry, results, snapshotEntry(entry))
+	}
+	return results, nil
+}
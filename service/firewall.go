@@ -0,0 +1,68 @@
+package service
+
+import (
+	"fmt"
+
+	"outputGuard/global"
+)
+
+// gateway可选的防火墙后端
+const (
+	BackendIptables = "iptables"
+	BackendIpset    = "ipset"
+	BackendNftables = "nftables"
+)
+
+/*
+ * gateway的防火墙后端
+ * 同样的server消息可以驱动不同的后端
+ */
+type Firewall interface {
+	// Init 放行内网网段、转发与desired中的规则,最后添加drop all;desired为nil时保留当前规则
+	Init(desired []global.Messages) error
+	// Apply 应用一条add/del消息,重复应用是幂等的
+	Apply(m global.Messages) error
+	// ApplyBatch 按顺序应用一批消息,整批一次性写入
+	// iptables与nftables后端失败时整批不生效,ipset后端失败时可能部分生效,调用方需逐条重新应用
+	ApplyBatch(messages []global.Messages) error
+	// Reconcile 按快照对齐规则
+	Reconcile(desired []global.Messages) (added, removed int, err error)
+	// Verify 比较实际规则与期望状态,不修改规则
+	Verify(desired []global.Messages) (Drift, error)
+	// Cache 当前由server下发的规则
+	Cache() ([]global.Messages, error)
+	// Count 每个ip的流量
+	Count() ([]global.ExporterData, error)
+	// IPv6 是否支持IPv6
+	IPv6() bool
+	// Uninstall 删除outputGuard创建的所有规则
+	Uninstall() error
+}
+
+var (
+	_ Firewall = (*IptableRules)(nil)
+	_ Firewall = (*IpsetRules)(nil)
+	_ Firewall = (*NftRules)(nil)
+)
+
+// NewFirewall nftables后端不依赖iptables命令
+func NewFirewall(backend string) (Firewall, error) {
+	switch backend {
+	case "", BackendIptables:
+		ipt, err := NewIpts()
+		if err != nil {
+			return nil, err
+		}
+		return &ipt, nil
+	case BackendIpset:
+		ipt, err := NewIpts()
+		if err != nil {
+			return nil, err
+		}
+		return NewIpsetRules(ipt)
+	case BackendNftables:
+		return NewNftRules()
+	default:
+		return nil, fmt.Errorf("不支持的防火墙后端:%s", backend)
+	}
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"outputGuard/global"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 每个gateway保留最近的应用错误数
+const maxApplyErrors = 20
+
+type ApplyError struct {
+	Revision uint64 `json:"revision"`
+	Key      string `json:"key,omitempty"`
+	Error    string `json:"error"`
+	Attempt  int    `json:"attempt,omitempty"`
+	// gateway已放弃重试
+	DeadLetter bool      `json:"dead_letter"`
+	Time       time.Time `json:"time"`
+}
+
+type GatewayView struct {
+	Hostname        string       `json:"hostname"`
+	RemoteAddr      string       `json:"remote_addr"`
+	Version         string       `json:"version"`
+	ConnectedAt     time.Time    `json:"connected_at"`
+	LastHeartbeat   time.Time    `json:"last_heartbeat"`
+	AppliedRevision uint64       `json:"applied_revision"`
+	Converged       bool         `json:"converged"`
+	Rules           int          `json:"rules"`
+	Errors          []ApplyError `json:"errors"`
+}
+
+// recordAck 记录ack与failure中的错误,快照应用成功后清空之前的错误,调用方需持有server.mutex
+func (c *Client) recordAck(envelope global.Envelope) {
+	if envelope.Error == "" {
+		if envelope.Snapshot {
+			c.errors = nil
+		}
+		return
+	}
+	c.errors = append(c.errors, ApplyError{
+		Revision:   envelope.Revision,
+		Key:        envelope.Key,
+		Error:      envelope.Error,
+		Attempt:    envelope.Attempt,
+		DeadLetter: envelope.DeadLetter,
+		Time:       time.Now(),
+	})
+	if len(c.errors) > maxApplyErrors {
+		c.errors = c.errors[len(c.errors)-maxApplyErrors:]
+	}
+}
+
+// Gateways 当前已连接的gateway,按hostname排序
+func (s *WssServer) Gateways() ([]GatewayView, uint64) {
+	revision := s.currentRevision()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	views := make([]GatewayView, 0, len(s.clients))
+	for c := range s.clients {
+		errors := make([]ApplyError, len(c.errors))
+		copy(errors, c.errors)
+		views = append(views, GatewayView{
+			Hostname:        c.hostname,
+			RemoteAddr:      c.remoteAddr,
+			Version:         c.version,
+			ConnectedAt:     c.connectedAt,
+			LastHeartbeat:   c.lastSeen,
+			AppliedRevision: c.applied,
+			Converged:       c.applied >= revision && len(c.errors) == 0,
+			Rules:           c.rules,
+			Errors:          errors,
+		})
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].Hostname < views[j].Hostname
+	})
+	return views, revision
+}
+
+func (hs *HttpServer) ListGateways(ctx *gin.Context) {
+	gateways, revision := hs.WssServer.Gateways()
+	ctx.JSON(http.StatusOK, gin.H{
+		"revision": revision,
+		"gateways": gateways,
+	})
+}
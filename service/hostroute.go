@@ -9,39 +9,64 @@ import (
 )
 
 type HostRouter struct {
-	DefaultLinkIdex int
-	GatewayAddr     string
+	DefaultLinkIdex  int
+	DefaultLinkIdex6 int
+	GatewayAddr      string
+	GatewayAddr6     string
 }
 
+/*
+ * 分别查找IPv4与IPv6默认路由所在的网卡
+ * 没有IPv6默认路由时不支持IPv6路由
+ */
 func NewHostRouter() *HostRouter {
-	var defaultLinkIndex int
-	routes, err := netlink.RouteList(nil, netlink.NewRule().Family)
+	defaultLinkIndex := defaultRouteLink(netlink.FAMILY_V4)
+	if defaultLinkIndex == 0 {
+		Logger.Panic("默认网卡未找到")
+	}
+	return &HostRouter{
+		DefaultLinkIdex:  defaultLinkIndex,
+		DefaultLinkIdex6: defaultRouteLink(netlink.FAMILY_V6),
+	}
+
+}
+
+func defaultRouteLink(family int) int {
+	routes, err := netlink.RouteList(nil, family)
 	if err != nil {
 		Logger.Panic(fmt.Sprintf("获取默认网卡失败: %s", err.Error()))
 	}
 	for _, route := range routes {
 		// 默认路由的Dst字段是nil，Gw不是nil
 		if route.Dst == nil && route.Gw != nil {
-			defaultLinkIndex = route.LinkIndex
-			break
+			return route.LinkIndex
 		}
 	}
-	if defaultLinkIndex == 0 {
-		Logger.Panic("默认网卡未找到")
-	}
-	return &HostRouter{
-		DefaultLinkIdex: defaultLinkIndex,
-	}
+	return 0
+}
 
+// familyOf 返回地址族、掩码总位数、网关与网卡
+func (hr *HostRouter) familyOf(destIP net.IP) (int, int, string, int) {
+	if destIP.To4() != nil {
+		return netlink.FAMILY_V4, 32, hr.GatewayAddr, hr.DefaultLinkIdex
+	}
+	return netlink.FAMILY_V6, 128, hr.GatewayAddr6, hr.DefaultLinkIdex6
 }
 
 // AddCustomRoute 添加自定义路由
 func (hr *HostRouter) AddCustomRoute(destination string, cidr int) error {
 	destIP := net.ParseIP(destination)
-	gwIP := net.ParseIP(hr.GatewayAddr)
-	if gwIP == nil || destIP == nil {
+	if destIP == nil {
 		return fmt.Errorf("invalid IP address")
 	}
+	_, bits, gateway, linkIndex := hr.familyOf(destIP)
+	gwIP := net.ParseIP(gateway)
+	if gwIP == nil {
+		return fmt.Errorf("invalid gateway address for %s", destination)
+	}
+	if linkIndex == 0 {
+		return fmt.Errorf("未找到%s对应的默认网卡", destination)
+	}
 	isLocal, err := isPrivateIP(destination)
 	if err != nil {
 		return fmt.Errorf("校验目标 IP 是否是内网 IP 失败: %s", err.Error())
@@ -54,9 +79,9 @@ func (hr *HostRouter) AddCustomRoute(destination string, cidr int) error {
 
 	// 如果目标 IP 不是内网 IP，执行带网关的路由添加
 	route := netlink.Route{
-		Dst:       &net.IPNet{IP: destIP, Mask: net.CIDRMask(cidr, 32)},
+		Dst:       &net.IPNet{IP: destIP, Mask: net.CIDRMask(cidr, bits)},
 		Gw:        gwIP,
-		LinkIndex: hr.DefaultLinkIdex,
+		LinkIndex: linkIndex,
 	}
 
 	if hr.RouteExists(destination) {
@@ -86,10 +111,11 @@ func (hr *HostRouter) DeleteCustomRoute(destination string, cidr int) error {
 	if destIP == nil {
 		return fmt.Errorf("invalid IP address")
 	}
+	_, bits, _, linkIndex := hr.familyOf(destIP)
 
 	route := netlink.Route{
-		Dst:       &net.IPNet{IP: destIP, Mask: net.CIDRMask(cidr, 32)},
-		LinkIndex: hr.DefaultLinkIdex,
+		Dst:       &net.IPNet{IP: destIP, Mask: net.CIDRMask(cidr, bits)},
+		LinkIndex: linkIndex,
 	}
 	if hr.RouteExists(destination) {
 		if err := netlink.RouteDel(&route); err != nil {
@@ -106,14 +132,15 @@ func (hr *HostRouter) RouteExists(destination string) bool {
 	if destIP == nil {
 		return false
 	}
-	routes, err := netlink.RouteList(nil, netlink.NewRule().Family)
+	family, _, _, linkIndex := hr.familyOf(destIP)
+	routes, err := netlink.RouteList(nil, family)
 	if err != nil {
 		Logger.Error(fmt.Sprintf("获取路由列表失败: %s", err.Error()))
 		return false
 	}
 
 	for _, route := range routes {
-		if route.Dst != nil && route.Dst.IP.Equal(destIP) && route.LinkIndex == hr.DefaultLinkIdex {
+		if route.Dst != nil && route.Dst.IP.Equal(destIP) && route.LinkIndex == linkIndex {
 			return true
 		}
 	}
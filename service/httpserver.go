@@ -1,16 +1,15 @@
 package service
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
-	"sync"
 	"time"
 
-	"outputGuard/global"
 	. "outputGuard/logger"
 
 	"github.com/gin-gonic/gin"
@@ -20,10 +19,18 @@ import (
 type HttpServer struct {
 	WssServer *WssServer
 	Ss        *ServerService
+	Auth      *Authenticator
+	// 不为空时使用https/wss
+	TLS *tls.Config
 }
 
 func (hs *HttpServer) handleWebSocket(ctx *gin.Context) {
-	hostname := ctx.Query("hostname")
+	hostname, ok := hs.Auth.AuthenticateGateway(ctx.Query("hostname"), ctx.Request)
+	if !ok {
+		Logger.Warn(fmt.Sprintf("未登记的gateway:%s(%s)尝试注册,已拒绝", hostname, ctx.ClientIP()))
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true
@@ -37,10 +44,14 @@ func (hs *HttpServer) handleWebSocket(ctx *gin.Context) {
 	}
 
 	client := &Client{
-		conn:     conn,
-		send:     make(chan []byte, 1024),
-		hostname: hostname,
-		server:   hs.WssServer,
+		conn:        conn,
+		send:        make(chan []byte, 1024),
+		resync:      make(chan struct{}, 1),
+		hostname:    hostname,
+		remoteAddr:  ctx.ClientIP(),
+		version:     ctx.Query("version"),
+		connectedAt: time.Now(),
+		server:      hs.WssServer,
 	}
 	hs.WssServer.register <- client
 
@@ -48,14 +59,23 @@ func (hs *HttpServer) handleWebSocket(ctx *gin.Context) {
 	go client.ReadPump()
 }
 
+// Apis 旧版接口,保留给已有的脚本使用,新的调用方请使用/api/v1/entries
 func (hs *HttpServer) Apis(ctx *gin.Context) {
 
 	add := ctx.Query("add")
 	del := ctx.Query("del")
 
-	var messageStruct global.Messages
 	if add != "" {
-		result, err := hs.Ss.ServerAction(add)
+		isNoDelStr := ctx.Query("nonDeletable")
+		if isNoDelStr == "" {
+			isNoDelStr = "false"
+		}
+		isNoDel, err := strconv.ParseBool(isNoDelStr)
+		if err != nil {
+			Logger.Error(fmt.Sprintf("nonDeletable:解析%s失败:%s", isNoDelStr, err.Error()))
+			isNoDel = false
+		}
+		name, err := hs.legacyAdd(add, isNoDel, operatorFrom(ctx, ctx.Query("reason")))
 		if err != nil {
 			Logger.Error(fmt.Sprintf("add:解析%s失败:%s", add, err.Error()))
 			ctx.JSON(http.StatusBadRequest, gin.H{
@@ -64,123 +84,19 @@ func (hs *HttpServer) Apis(ctx *gin.Context) {
 			})
 			return
 		}
-		addSem := make(chan struct{}, len(result.IP))
-		addWg := sync.WaitGroup{}
-
-		for _, ip := range result.IP {
-			isNoDelStr := ctx.Query("nonDeletable")
-			if isNoDelStr == "" {
-				isNoDelStr = "false"
-			}
-			isNoDel, err := strconv.ParseBool(isNoDelStr)
-			if err != nil {
-				Logger.Error(fmt.Sprintf("nonDeletable:解析%s失败:%s", isNoDelStr, err.Error()))
-				isNoDel = false
-			}
-			addSem <- struct{}{}
-			addWg.Add(1)
-			go func(ip string, messageStruct global.Messages, ctx *gin.Context) {
-
-				defer func() {
-					<-addSem
-					addWg.Done()
-				}()
-				isLocal, err := isPrivateIP(ip)
-				if err != nil {
-					Logger.Error(fmt.Sprintf("isPrivateIP:解析%s失败:%s", ip, err.Error()))
-				}
-				go func(ip, types, Name string, isNoDel, isLocal bool) {
-
-					if isLocal { // 内网ip强制设置为不可删除
-						isNoDel = isLocal
-					}
-					if err := hs.WssServer.Orms.Add(types, ip, Name, time.Now().Local(), isNoDel, isLocal); err != nil {
-						Logger.Error(fmt.Sprintf("添加%s 失败: %s", result.Name, err.Error()))
-					}
-				}(ip, result.Type, result.Name, isNoDel, isLocal)
-				messageStruct.Action = "add"
-				messageStruct.IP = ip
-				messageStruct.IsLocalNet = isLocal
-
-				messageJson, err := json.Marshal(messageStruct)
-				if err != nil {
-					ctx.JSON(http.StatusBadRequest, gin.H{
-						"info":   err.Error(),
-						"status": "failed",
-					})
-					Logger.Error(fmt.Sprintf("Error marshaling message: %s", err.Error()))
-					return
-				}
-				Logger.Info(fmt.Sprint("即将发布的add任务:", string(messageJson)))
-				hs.WssServer.broadcast <- []byte(messageJson)
-
-			}(ip, messageStruct, ctx)
-		}
-		addWg.Wait()
 		ctx.JSON(http.StatusOK, gin.H{
-			"info":   result.Name,
+			"info":   name,
 			"status": "success",
 		})
 	}
 	if del != "" {
-		result, err := hs.Ss.ServerAction(del)
-		if err != nil {
-			ctx.JSON(http.StatusBadRequest, gin.H{
+		if err := hs.legacyDel(del, operatorFrom(ctx, ctx.Query("reason"))); err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 				"info":   err.Error(),
 				"status": "failed",
 			})
 			return
 		}
-		delSem := make(chan struct{}, len(result.IP))
-		delWg := sync.WaitGroup{}
-		for _, ip := range result.IP {
-			noDel, err := hs.WssServer.Orms.QueryNoDel(ip)
-			if err != nil {
-				Logger.Error(fmt.Sprintf("查询%s 是否可删除失败: %s", result.Name, err.Error()))
-			}
-			if noDel {
-				ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-					"info":   fmt.Sprintf("%s 不可删除", ip),
-					"status": "failed",
-				})
-				return
-			}
-			delSem <- struct{}{}
-			delWg.Add(1)
-			go func(ip string, messageStruct global.Messages, ctx *gin.Context) {
-
-				defer func() {
-					<-delSem
-					delWg.Done()
-				}()
-
-				go func(ip string) {
-					if err := hs.WssServer.Orms.Del(ip); err != nil {
-						Logger.Error(fmt.Sprintf("删除%s 失败: %s", result.Name, err.Error()))
-					}
-				}(ip)
-				isLocal, err := isPrivateIP(ip)
-				if err != nil {
-					Logger.Error(fmt.Sprintf("isPrivateIP:解析%s失败:%s", ip, err.Error()))
-				}
-				messageStruct.Action = "del"
-				messageStruct.IP = ip
-				messageStruct.IsLocalNet = isLocal
-				messageJson, err := json.Marshal(messageStruct)
-				if err != nil {
-					ctx.JSON(http.StatusBadRequest, gin.H{
-						"info":   err.Error(),
-						"status": "failed",
-					})
-					Logger.Error(fmt.Sprintf("Error marshaling message: %s", err.Error()))
-					return
-				}
-				Logger.Info(fmt.Sprint("即将发布的del任务:", string(messageJson)))
-				hs.WssServer.broadcast <- []byte(messageJson)
-
-			}(ip, messageStruct, ctx)
-		}
-		delWg.Wait()
 		ctx.JSON(http.StatusOK, gin.H{
 			"info":   del,
 			"status": "success",
@@ -188,6 +104,60 @@ func (hs *HttpServer) Apis(ctx *gin.Context) {
 	}
 }
 
+// legacyAdd 旧接口对已存在的条目追加新解析到的ip
+func (hs *HttpServer) legacyAdd(add string, isNoDel bool, op Operator) (string, error) {
+	entry, _, err := hs.createEntry(EntrySpec{Name: add, NonDeletable: isNoDel}, op)
+	if err == nil {
+		return entry.Name, nil
+	}
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != CodeEntryExists {
+		return "", err
+	}
+	result, err := hs.Ss.ServerAction(add)
+	if err != nil {
+		return "", err
+	}
+	entry, err = hs.WssServer.Orms.GetEntryByTarget(result.Name, "", "", "")
+	if err != nil {
+		return "", err
+	}
+	if entry == nil {
+		return "", fmt.Errorf("%s 不存在", result.Name)
+	}
+	before := snapshotEntry(entry)
+	results := hs.WssServer.addEntryIPs(entry, result.IP)
+	hs.WssServer.auditWithReload(op, AuditAddIPs, entry, results, before)
+	return entry.Name, nil
+}
+
+func (hs *HttpServer) legacyDel(del string, op Operator) error {
+	result, err := hs.Ss.ServerAction(del)
+	if err != nil {
+		return err
+	}
+	entry, err := hs.WssServer.Orms.GetEntryByTarget(result.Name, "", "", "")
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("%s 不存在", result.Name)
+	}
+	results, err := hs.deleteEntry(entry, false, op)
+	if err != nil {
+		return err
+	}
+	for _, res := range results {
+		switch res.Status {
+		case IPStatusProtected:
+			return fmt.Errorf("%s 不可删除", res.IP)
+		case IPStatusFailed:
+			return fmt.Errorf("删除%s失败:%s", res.IP, res.Error)
+		}
+	}
+	return nil
+}
+
 func (hs *HttpServer) ShowAll(c *gin.Context) {
 	allRecords, err := hs.WssServer.Orms.QueryAll()
 	if err != nil {
@@ -229,10 +199,19 @@ func (hs *HttpServer) RunServerService() {
 		})
 	})
 
-	r.GET("/show-all", hs.ShowAll)
-	r.GET("/api", hs.Apis)
+	r.GET("/show-all", hs.Auth.Require(RoleViewer), hs.ShowAll)
+	r.GET("/api", hs.Auth.Require(RoleApprover), hs.Apis)
+	hs.registerV1(r)
 
-	if err := r.Run(":8080"); err != nil {
-		Logger.Panic(fmt.Sprintf("HTTP server failed: %s", err.Error()))
+	if hs.TLS == nil {
+		if err := r.Run(":8080"); err != nil {
+			Logger.Panic(fmt.Sprintf("HTTP server failed: %s", err.Error()))
+		}
+		return
+	}
+	srv := &http.Server{Addr: ":8080", Handler: r, TLSConfig: hs.TLS}
+	// 证书已在TLSConfig中加载
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
+		Logger.Panic(fmt.Sprintf("HTTPS server failed: %s", err.Error()))
 	}
 }
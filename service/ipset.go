@@ -0,0 +1,636 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"outputGuard/global"
+	. "outputGuard/logger"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+/*
+ * ipset后端
+ * 目的地址保存在hash:net集合中,每种协议/端口组合只对应固定的几条iptables规则
+ * 集合名: og4-<spec>、og6-<spec>,不限制协议时spec为all,否则为协议/端口的哈希
+ * 每种spec有三个集合:
+ *   og4-<spec>    出网方向,FORWARD中更新计数
+ *   og4-<spec>-in 回包方向,FORWARD中更新计数
+ *   og4-<spec>-l  内网地址,只放行INPUT/OUTPUT
+ * 其他规则使用! --update-counters,集合元素的计数只统计转发的流量
+ */
+const (
+	ipsetPrefix4 = "og4-"
+	ipsetPrefix6 = "og6-"
+	ipsetIn      = "-in"
+	ipsetLocal   = "-l"
+)
+
+// isOgSet 只处理og4-、og6-开头的集合,避免误操作其他程序创建的同名前缀集合
+func isOgSet(name string) bool {
+	return strings.HasPrefix(name, ipsetPrefix4) || strings.HasPrefix(name, ipsetPrefix6)
+}
+
+type IpsetRules struct {
+	ipt   IptableRules
+	mutex sync.Mutex
+	// 已创建的集合,value为生成规则用的模板
+	ensured map[string]global.Messages
+}
+
+func NewIpsetRules(ipt IptableRules) (*IpsetRules, error) {
+	if _, err := exec.LookPath("ipset"); err != nil {
+		return nil, fmt.Errorf("未找到ipset命令:%v", err)
+	}
+	return &IpsetRules{ipt: ipt, ensured: make(map[string]global.Messages)}, nil
+}
+
+func (is *IpsetRules) IPv6() bool {
+	return is.ipt.IPv6()
+}
+
+/*
+ * Init 内网网段、转发与drop all规则与iptables后端相同
+ * 已有集合对应的规则从当前OUTPUT链中还原后整体重写,desired中的地址在重写前加入集合
+ */
+func (is *IpsetRules) Init(desired []global.Messages) error {
+	if err := is.ipt.EnsureChains(); err != nil {
+		return fmt.Errorf("创建outputGuard链失败:%v", err)
+	}
+	if err := is.ipt.CheckForwardAcceptRule(); err != nil {
+		return fmt.Errorf("添加forward accept规则失败:%v", err)
+	}
+	specs, err := is.setSpecs()
+	if err != nil {
+		return err
+	}
+	sets, err := ipsetList()
+	if err != nil {
+		return err
+	}
+	is.mutex.Lock()
+	defer is.mutex.Unlock()
+	ensured := make(map[string]global.Messages, len(specs))
+	for name, spec := range specs {
+		// 被引用的集合已删除时不再生成规则,收到消息时重新创建
+		if !sets[name] {
+			continue
+		}
+		spec.IP = "0.0.0.0/0"
+		if strings.HasPrefix(name, ipsetPrefix6) {
+			spec.IP = "::/0"
+		}
+		spec.IsLocalNet = strings.HasSuffix(name, ipsetLocal)
+		ensured[ipsetKey(spec)] = spec
+	}
+	// 集合与元素先于引用集合的规则写入,drop规则生效时期望的地址已经放行
+	var script strings.Builder
+	for _, m := range desired {
+		if _, err := is.ipt.iptFor(m.IP); err != nil {
+			Logger.Warn(fmt.Sprintf("初始化时跳过%s:%s", m.Key(), err.Error()))
+			continue
+		}
+		family := "inet"
+		if isIPv6(m.IP) {
+			family = "inet6"
+		}
+		for _, name := range ipsetNames(m) {
+			fmt.Fprintf(&script, "create %s hash:net family %s counters\n", name, family)
+			fmt.Fprintf(&script, "add %s %s\n", name, m.IP)
+		}
+		if _, ok := ensured[ipsetKey(m)]; !ok {
+			ensured[ipsetKey(m)] = m
+		}
+	}
+	if script.Len() > 0 {
+		if _, err := runIpset(script.String(), "-exist", "restore"); err != nil {
+			return err
+		}
+	}
+	if err := is.render(ensured); err != nil {
+		return err
+	}
+	is.ensured = ensured
+	return nil
+}
+
+// render 按已创建的集合重写自有链
+func (is *IpsetRules) render(ensured map[string]global.Messages) error {
+	rules := is.build(ensured)
+	for _, ipt := range is.ipt.families() {
+		if err := is.ipt.restore(ipt, rules[ipt]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (is *IpsetRules) build(ensured map[string]global.Messages) map[*iptables.IPTables]chainRules {
+	keys := make([]string, 0, len(ensured))
+	for k := range ensured {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	rules := make(map[*iptables.IPTables]chainRules)
+	for _, ipt := range is.ipt.families() {
+		v6 := ipt == is.ipt.Ipt6
+		cr := baseRules(v6)
+		for _, k := range keys {
+			if isIPv6(ensured[k].IP) != v6 {
+				continue
+			}
+			for _, rule := range ipsetRules(ensured[k]) {
+				cr.add(rule.builtin, rule.spec...)
+			}
+		}
+		cr.dropAll()
+		rules[ipt] = cr
+	}
+	return rules
+}
+
+/*
+ * Verify 比较集合中的元素与期望状态
+ * 集合被删除时从已创建的记录中移除,修复时重新创建
+ */
+func (is *IpsetRules) Verify(desired []global.Messages) (Drift, error) {
+	supported := make([]global.Messages, 0, len(desired))
+	for _, m := range desired {
+		if _, err := is.ipt.iptFor(m.IP); err == nil {
+			supported = append(supported, m)
+		}
+	}
+	live, err := is.Cache()
+	if err != nil {
+		return Drift{}, err
+	}
+	drift := diffMessages(supported, live)
+	sets, err := ipsetList()
+	if err != nil {
+		return Drift{}, err
+	}
+	is.mutex.Lock()
+	defer is.mutex.Unlock()
+	for key, m := range is.ensured {
+		for _, name := range ipsetNames(m) {
+			if !sets[name] {
+				drift.Structure = append(drift.Structure, fmt.Sprintf("ipset集合%s不存在", name))
+				delete(is.ensured, key)
+			}
+		}
+	}
+	structure, err := is.ipt.verifyChains(is.build(is.ensured))
+	if err != nil {
+		return Drift{}, err
+	}
+	drift.Structure = append(drift.Structure, structure...)
+	return drift, nil
+}
+
+// ipsetList 已存在的集合名
+func ipsetList() (map[string]bool, error) {
+	out, err := runIpset("", "list", "-n")
+	if err != nil {
+		return nil, err
+	}
+	sets := make(map[string]bool)
+	for _, name := range strings.Fields(string(out)) {
+		sets[name] = true
+	}
+	return sets, nil
+}
+
+// Uninstall 先删除引用集合的链,再删除集合
+func (is *IpsetRules) Uninstall() error {
+	if err := is.ipt.Uninstall(); err != nil {
+		return err
+	}
+	sets, err := ipsetList()
+	if err != nil {
+		return err
+	}
+	for name := range sets {
+		if !isOgSet(name) {
+			continue
+		}
+		if _, err := runIpset("", "destroy", name); err != nil {
+			return err
+		}
+		Logger.Info(fmt.Sprintf("已删除ipset集合%s", name))
+	}
+	is.mutex.Lock()
+	is.ensured = make(map[string]global.Messages)
+	is.mutex.Unlock()
+	return nil
+}
+
+// ipsetSpecID 集合名最长31个字符,协议/端口使用哈希
+func ipsetSpecID(m global.Messages) string {
+	if m.Protocol == "" && m.Sources == "" {
+		return "all"
+	}
+	spec := m.Protocol + "/" + m.Ports
+	if m.Sources != "" {
+		spec += "@" + m.Sources
+	}
+	sum := sha1.Sum([]byte(spec))
+	return hex.EncodeToString(sum[:4])
+}
+
+func ipsetBase(m global.Messages) string {
+	prefix := ipsetPrefix4
+	if isIPv6(m.IP) {
+		prefix = ipsetPrefix6
+	}
+	return prefix + ipsetSpecID(m)
+}
+
+// ipsetNames 消息对应的集合
+func ipsetNames(m global.Messages) []string {
+	base := ipsetBase(m)
+	if m.IsLocalNet {
+		return []string{base + ipsetLocal}
+	}
+	return []string{base, base + ipsetIn}
+}
+
+func matchSet(name, dir string, count bool) []string {
+	spec := []string{"-m", "set", "--match-set", name, dir}
+	if !count {
+		spec = append(spec, "!", "--update-counters")
+	}
+	return spec
+}
+
+// ipsetRule 自有链中的规则,builtin为对应的内置链
+type ipsetRule struct {
+	builtin string
+	spec    []string
+}
+
+/*
+ * ipsetRules 集合对应的iptables规则
+ * 限制源网段时转发与伪装规则按源网段生成,源网段记录在注释中
+ */
+func ipsetRules(m global.Messages) []ipsetRule {
+	base := ipsetBase(m)
+	dports := portMatch(m, true)
+	sports := portMatch(m, false)
+	rule := func(builtin string, match, ports []string, target string) ipsetRule {
+		spec := append(append(append([]string{}, match...), ports...), sourceComment(m)...)
+		return ipsetRule{builtin: builtin, spec: append(spec, "-j", target)}
+	}
+	if m.IsLocalNet {
+		local := base + ipsetLocal
+		return []ipsetRule{
+			rule("INPUT", matchSet(local, "src", true), sports, "ACCEPT"),
+			rule("OUTPUT", matchSet(local, "dst", true), dports, "ACCEPT"),
+		}
+	}
+	in := base + ipsetIn
+	rules := []ipsetRule{
+		rule("INPUT", matchSet(in, "src", false), sports, "ACCEPT"),
+		rule("OUTPUT", matchSet(base, "dst", false), dports, "ACCEPT"),
+	}
+	if m.Sources == "" {
+		return append(rules,
+			rule("FORWARD", matchSet(in, "src", true), sports, "ACCEPT"),
+			rule("FORWARD", matchSet(base, "dst", true), dports, "ACCEPT"),
+			rule("POSTROUTING", matchSet(base, "dst", false), dports, "MASQUERADE"),
+		)
+	}
+	for _, source := range allowedSources(m) {
+		rules = append(rules,
+			rule("FORWARD", append([]string{"-d", source}, matchSet(in, "src", true)...), sports, "ACCEPT"),
+			rule("FORWARD", append([]string{"-s", source}, matchSet(base, "dst", true)...), dports, "ACCEPT"),
+			rule("POSTROUTING", append([]string{"-s", source}, matchSet(base, "dst", false)...), dports, "MASQUERADE"),
+		)
+	}
+	return rules
+}
+
+func ipsetKey(m global.Messages) string {
+	if m.IsLocalNet {
+		return ipsetBase(m) + ipsetLocal
+	}
+	return ipsetBase(m)
+}
+
+/*
+ * ensure 创建集合,出现新的spec时重写自有链
+ * 一批消息的集合通过一次ipset restore创建,自有链只重写一次
+ */
+func (is *IpsetRules) ensure(messages ...global.Messages) error {
+	is.mutex.Lock()
+	defer is.mutex.Unlock()
+	var script strings.Builder
+	added := make(map[string]global.Messages)
+	for _, m := range messages {
+		key := ipsetKey(m)
+		if _, ok := is.ensured[key]; ok {
+			continue
+		}
+		if _, ok := added[key]; ok {
+			continue
+		}
+		if _, err := is.ipt.iptFor(m.IP); err != nil {
+			return err
+		}
+		family := "inet"
+		if isIPv6(m.IP) {
+			family = "inet6"
+		}
+		for _, name := range ipsetNames(m) {
+			fmt.Fprintf(&script, "create %s hash:net family %s counters\n", name, family)
+		}
+		added[key] = m
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	if _, err := runIpset(script.String(), "-exist", "restore"); err != nil {
+		return err
+	}
+	ensured := make(map[string]global.Messages, len(is.ensured)+len(added))
+	for k, v := range is.ensured {
+		ensured[k] = v
+	}
+	for k, v := range added {
+		ensured[k] = v
+	}
+	if err := is.render(ensured); err != nil {
+		return err
+	}
+	is.ensured = ensured
+	return nil
+}
+
+func (is *IpsetRules) Apply(m global.Messages) error {
+	return is.ApplyBatch([]global.Messages{m})
+}
+
+/*
+ * 一批消息通过一次ipset restore写入
+ * 新的集合与引用集合的规则先于元素一次性创建,删除只针对已存在的集合,集合不存在时元素也不存在
+ * ipset restore不是事务性的,失败时之前的行已经生效,由调用方逐条重新应用
+ */
+func (is *IpsetRules) ApplyBatch(messages []global.Messages) error {
+	adds := make([]global.Messages, 0, len(messages))
+	for _, m := range messages {
+		switch m.Action {
+		case global.ActionAdd:
+			adds = append(adds, m)
+		case global.ActionDel:
+		default:
+			return fmt.Errorf("未知的行为:%s", m.Action)
+		}
+	}
+	if err := is.ensure(adds...); err != nil {
+		return fmt.Errorf("创建ipset集合失败:%v", err)
+	}
+	var script strings.Builder
+	is.mutex.Lock()
+	for _, m := range messages {
+		if m.Action == global.ActionDel {
+			if _, ok := is.ensured[ipsetKey(m)]; !ok {
+				continue
+			}
+		}
+		for _, name := range ipsetNames(m) {
+			fmt.Fprintf(&script, "%s %s %s\n", m.Action, name, m.IP)
+		}
+	}
+	is.mutex.Unlock()
+	if script.Len() == 0 {
+		return nil
+	}
+	_, err := runIpset(script.String(), "-exist", "restore")
+	return err
+}
+
+/*
+ * 按快照对齐
+ * 集合的增删通过一次ipset restore完成
+ */
+func (is *IpsetRules) Reconcile(desired []global.Messages) (added, removed int, err error) {
+	current, err := is.Cache()
+	if err != nil {
+		return 0, 0, err
+	}
+	currentKeys := make(map[string]bool, len(current))
+	for _, m := range current {
+		currentKeys[m.Key()] = true
+	}
+	desiredKeys := make(map[string]bool, len(desired))
+	for _, m := range desired {
+		desiredKeys[m.Key()] = true
+	}
+
+	var script strings.Builder
+	for _, m := range current {
+		if desiredKeys[m.Key()] {
+			continue
+		}
+		for _, name := range ipsetNames(m) {
+			fmt.Fprintf(&script, "del %s %s\n", name, m.IP)
+		}
+		removed++
+		Logger.Info(fmt.Sprintf("对齐时删除server端已不存在的规则:%s", m.Key()))
+	}
+	failed := 0
+	for _, m := range desired {
+		if err := is.ensure(m); err != nil {
+			failed++
+			Logger.Error(fmt.Sprintf("对齐时创建%s的集合失败:%s", m.Key(), err.Error()))
+			continue
+		}
+		for _, name := range ipsetNames(m) {
+			fmt.Fprintf(&script, "add %s %s\n", name, m.IP)
+		}
+		if !currentKeys[m.Key()] {
+			added++
+		}
+	}
+	if script.Len() > 0 {
+		if _, err := runIpset(script.String(), "-exist", "restore"); err != nil {
+			return 0, 0, err
+		}
+	}
+	if failed > 0 {
+		return added, removed, fmt.Errorf("%d条规则对齐失败", failed)
+	}
+	return added, removed, nil
+}
+
+// Cache 集合中的元素,协议/端口从引用集合的OUTPUT规则中还原
+func (is *IpsetRules) Cache() ([]global.Messages, error) {
+	specs, err := is.setSpecs()
+	if err != nil {
+		return nil, err
+	}
+	elements, err := ipsetSave()
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]global.Messages, 0, len(elements))
+	for _, e := range elements {
+		if strings.HasSuffix(e.set, ipsetIn) {
+			continue
+		}
+		spec, ok := specs[e.set]
+		if !ok {
+			Logger.Warn(fmt.Sprintf("集合%s没有对应的iptables规则,跳过%s", e.set, e.addr))
+			continue
+		}
+		spec.IP = global.CanonicalAddr(e.addr)
+		spec.IsLocalNet = strings.HasSuffix(e.set, ipsetLocal)
+		messages = append(messages, spec)
+	}
+	return messages, nil
+}
+
+// setSpecs 集合名 -> 协议/端口
+func (is *IpsetRules) setSpecs() (map[string]global.Messages, error) {
+	specs := make(map[string]global.Messages)
+	for _, ipt := range is.ipt.families() {
+		rules, err := ipt.List("filter", ogChain("OUTPUT"))
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			name, spec := parseSetRule(rule)
+			if name != "" {
+				specs[name] = spec
+			}
+		}
+	}
+	return specs, nil
+}
+
+func parseSetRule(rule string) (string, global.Messages) {
+	var name string
+	spec := global.Messages{Action: global.ActionAdd}
+	parts := strings.Fields(rule)
+	for i := 0; i < len(parts)-1; i++ {
+		switch parts[i] {
+		case "--match-set":
+			if isOgSet(parts[i+1]) {
+				name = parts[i+1]
+			}
+		case "-p":
+			spec.Protocol = parts[i+1]
+		case "--dports":
+			spec.Ports = strings.ReplaceAll(parts[i+1], ":", "-")
+		case "--comment":
+			spec.Sources = commentSources(parts[i+1])
+		}
+	}
+	return name, spec
+}
+
+// Count 出网方向与回包方向的集合分别对应iptables后端的POSTROUTING与FORWARD标签
+func (is *IpsetRules) Count() ([]global.ExporterData, error) {
+	elements, err := ipsetSave()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	uniqueRules := make(map[string]global.ExporterData)
+	for _, e := range elements {
+		if strings.HasSuffix(e.set, ipsetLocal) {
+			continue
+		}
+		ge := global.ExporterData{
+			ChainName: "POSTROUTING",
+			Direction: "OUTPUT",
+			Ip:        global.ExporterAddr(e.addr),
+			Packets:   e.packets,
+			Bytes:     e.bytes,
+			Hostname:  hostname,
+		}
+		if strings.HasSuffix(e.set, ipsetIn) {
+			ge.ChainName = "FORWARD"
+			ge.Direction = "INPUT"
+		}
+		mergeExporterData(uniqueRules, ge, e.set+" "+e.addr)
+	}
+	return exporterValues(uniqueRules), nil
+}
+
+// mergeExporterData 同一ip同一方向的多条规则计数相加,同时保留每条规则的计数
+func mergeExporterData(uniqueRules map[string]global.ExporterData, ge global.ExporterData, ruleKey string) {
+	key := fmt.Sprintf("%s_%s", ge.ChainName, ge.Ip)
+	ge.Rules = []global.RuleCounter{{Key: ruleKey, Packets: ge.Packets, Bytes: ge.Bytes}}
+	if existing, ok := uniqueRules[key]; ok {
+		ge.Packets += existing.Packets
+		ge.Bytes += existing.Bytes
+		ge.Rules = append(existing.Rules, ge.Rules...)
+	}
+	uniqueRules[key] = ge
+}
+
+func exporterValues(uniqueRules map[string]global.ExporterData) []global.ExporterData {
+	data := make([]global.ExporterData, 0, len(uniqueRules))
+	for _, ge := range uniqueRules {
+		data = append(data, ge)
+	}
+	return data
+}
+
+type ipsetElement struct {
+	set     string
+	addr    string
+	packets float64
+	bytes   float64
+}
+
+/*
+ * 解析ipset save的输出,格式如:
+ * add og4-all 1.1.1.1 packets 10 bytes 1000
+ */
+func ipsetSave() ([]ipsetElement, error) {
+	out, err := runIpset("", "save")
+	if err != nil {
+		return nil, err
+	}
+	elements := make([]ipsetElement, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 3 || parts[0] != "add" || !isOgSet(parts[1]) {
+			continue
+		}
+		e := ipsetElement{set: parts[1], addr: parts[2]}
+		for i := 3; i < len(parts)-1; i++ {
+			switch parts[i] {
+			case "packets":
+				e.packets, _ = toFloat64(parts[i+1])
+			case "bytes":
+				e.bytes, _ = toFloat64(parts[i+1])
+			}
+		}
+		elements = append(elements, e)
+	}
+	return elements, nil
+}
+
+func runIpset(stdin string, args ...string) ([]byte, error) {
+	cmd := exec.Command("ipset", args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ipset %s失败:%v:%s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
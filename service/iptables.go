@@ -2,16 +2,21 @@ package service
 
 import (
 	"outputGuard/global"
+	. "outputGuard/logger"
 
 	"fmt"
 	"os"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/coreos/go-iptables/iptables"
 )
 
+/*
+ * ip6tables不可用时只记录日志,IPv6的规则会添加失败
+ */
 func NewIpts() (IptableRules, error) {
 	irs := IptableRules{}
 	ipt, err := iptables.New()
@@ -19,115 +24,325 @@ func NewIpts() (IptableRules, error) {
 		return irs, err
 	}
 	irs.Ipt = ipt
+	ipt6, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err != nil {
+		Logger.Warn(fmt.Sprintf("初始化ip6tables失败,不支持IPv6:%s", err.Error()))
+	} else {
+		irs.Ipt6 = ipt6
+	}
 	irs.Table = "filter"
+	irs.state = &iptState{desired: make(map[string]global.Messages)}
 	return irs, nil
 
 }
 
 type IptableRules struct {
 	Ipt       *iptables.IPTables
+	Ipt6      *iptables.IPTables
 	ChainName string
 	Table     string
 	Packets   int
 	Bytes     int
+	state     *iptState
 }
 
-func (ir IptableRules) AddMasqueradeRule(ip string) error {
-	ruleSpec := []string{"-s", "0.0.0.0/0", "-d", ip, "-j", "MASQUERADE"}
+// iptState 期望的规则,key为消息的Key()
+type iptState struct {
+	mutex   sync.Mutex
+	desired map[string]global.Messages
+}
 
-	if err := ir.Ipt.InsertUnique("nat", "POSTROUTING", 1, ruleSpec...); err != nil {
-		return err
+/*
+ * 协议/端口匹配条件
+ * 协议为空时不附加任何条件,与旧版本生成的规则完全一致,保证能删除旧规则
+ * toDest为true时匹配目的端口,否则匹配源端口(回包方向)
+ */
+func portMatch(m global.Messages, toDest bool) []string {
+	if m.Protocol == "" {
+		return nil
+	}
+	spec := []string{"-p", m.Protocol}
+	if m.Ports == "" {
+		return spec
+	}
+	flag := "--sports"
+	if toDest {
+		flag = "--dports"
+	}
+	return append(spec, "-m", "multiport", flag, strings.ReplaceAll(m.Ports, "-", ":"))
+}
+
+// iptFor 按地址族选择iptables/ip6tables
+func (ir IptableRules) iptFor(addr string) (*iptables.IPTables, error) {
+	if !isIPv6(addr) {
+		return ir.Ipt, nil
 	}
+	if ir.Ipt6 == nil {
+		return nil, fmt.Errorf("ip6tables不可用,无法处理%s", addr)
+	}
+	return ir.Ipt6, nil
+}
 
-	return nil
+// families 所有可用的地址族
+func (ir IptableRules) families() []*iptables.IPTables {
+	if ir.Ipt6 == nil {
+		return []*iptables.IPTables{ir.Ipt}
+	}
+	return []*iptables.IPTables{ir.Ipt, ir.Ipt6}
 }
 
-func (ir IptableRules) DeleteMasqueradeRule(ip string) error {
+// 限制源网段的规则在注释中记录源网段,从规则还原消息时使用
+const sourceCommentPrefix = "og-src="
 
-	ruleSpec := []string{"-s", "0.0.0.0/0", "-d", ip, "-j", "MASQUERADE"}
-	if err := ir.Ipt.DeleteIfExists("nat", "POSTROUTING", ruleSpec...); err != nil {
-		return err
+func sourceComment(m global.Messages) []string {
+	if m.Sources == "" {
+		return nil
 	}
+	return []string{"-m", "comment", "--comment", sourceCommentPrefix + m.Sources}
+}
 
-	return nil
+// commentSources iptables输出的注释带引号
+func commentSources(comment string) string {
+	comment = strings.Trim(comment, "\"")
+	if !strings.HasPrefix(comment, sourceCommentPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(comment, sourceCommentPrefix)
 }
 
-func (ir IptableRules) AddForwordRule(ip string) error {
-	ruleIn := []string{"-s", ip, "-j", "ACCEPT"}
-	if err := ir.Ipt.InsertUnique(ir.Table, "FORWARD", 1, ruleIn...); err != nil {
-		return err
+// allowedSources 不限制源网段时为任意地址,限制时只取与目的地址同一地址族的源网段
+func allowedSources(m global.Messages) []string {
+	if m.Sources == "" {
+		if isIPv6(m.IP) {
+			return []string{"::/0"}
+		}
+		return []string{"0.0.0.0/0"}
 	}
-	ruleOut := []string{"-d", ip, "-j", "ACCEPT"}
-	if err := ir.Ipt.InsertUnique(ir.Table, "FORWARD", 1, ruleOut...); err != nil {
-		return err
+	return m.SourcesFor(isIPv6(m.IP))
+}
+
+func (ir IptableRules) masqueradeSpecs(m global.Messages) [][]string {
+	specs := make([][]string, 0)
+	for _, source := range allowedSources(m) {
+		ruleSpec := []string{"-s", source, "-d", m.IP}
+		ruleSpec = append(ruleSpec, portMatch(m, true)...)
+		ruleSpec = append(ruleSpec, sourceComment(m)...)
+		specs = append(specs, append(ruleSpec, "-j", "MASQUERADE"))
 	}
-	return nil
+	return specs
 }
 
-func (ir IptableRules) DeleteForwordRule(ip string) error {
-	ruleIn := []string{"-s", ip, "-j", "ACCEPT"}
-	if err := ir.Ipt.DeleteIfExists(ir.Table, "FORWARD", ruleIn...); err != nil {
-		return err
+/*
+ * forwardSpecs 依次为回包方向与出网方向的规则
+ * 限制源网段时每个源网段一组规则,源网段都不属于目的地址的地址族时没有转发规则
+ */
+func (ir IptableRules) forwardSpecs(m global.Messages) [][]string {
+	if m.Sources == "" {
+		ruleIn := append([]string{"-s", m.IP}, portMatch(m, false)...)
+		ruleOut := append([]string{"-d", m.IP}, portMatch(m, true)...)
+		return [][]string{
+			append(ruleIn, "-j", "ACCEPT"),
+			append(ruleOut, "-j", "ACCEPT"),
+		}
 	}
-	ruleOut := []string{"-d", ip, "-j", "ACCEPT"}
-	if err := ir.Ipt.DeleteIfExists(ir.Table, "FORWARD", ruleOut...); err != nil {
+	specs := make([][]string, 0)
+	for _, source := range allowedSources(m) {
+		ruleIn := append([]string{"-s", m.IP, "-d", source}, portMatch(m, false)...)
+		ruleOut := append([]string{"-s", source, "-d", m.IP}, portMatch(m, true)...)
+		specs = append(specs,
+			append(append(ruleIn, sourceComment(m)...), "-j", "ACCEPT"),
+			append(append(ruleOut, sourceComment(m)...), "-j", "ACCEPT"),
+		)
+	}
+	return specs
+}
 
-		return nil
+/*
+ * INPUT/OUTPUT规则
+ * 不限制协议时沿用旧版本的规则
+ * 限制协议/端口时INPUT匹配来自目的地址的回包,OUTPUT匹配发往目的地址的请求
+ */
+func (ir IptableRules) acceptSpecs(m global.Messages) map[string][]string {
+	if m.Protocol == "" {
+		ruleSpec := append(append([]string{"-s", m.IP}, sourceComment(m)...), "-j", "ACCEPT")
+		return map[string][]string{"INPUT": ruleSpec, "OUTPUT": ruleSpec}
+	}
+	ruleIn := append([]string{"-s", m.IP}, portMatch(m, false)...)
+	ruleOut := append([]string{"-d", m.IP}, portMatch(m, true)...)
+	return map[string][]string{
+		"INPUT":  append(append(ruleIn, sourceComment(m)...), "-j", "ACCEPT"),
+		"OUTPUT": append(append(ruleOut, sourceComment(m)...), "-j", "ACCEPT"),
 	}
-	return nil
 }
 
-func (ir IptableRules) AddAccept(ip string) error {
-	ruleSpec := []string{"-s", ip, "-j", "ACCEPT"}
+func (ir *IptableRules) IPv6() bool {
+	return ir.Ipt6 != nil
+}
 
-	if err := ir.Ipt.InsertUnique(ir.Table, "INPUT", 1, ruleSpec...); err != nil {
+/*
+ * Init 创建自有链并放行转发
+ * desired为nil时期望状态从当前规则中恢复,server下发快照前已有的规则继续生效
+ */
+func (ir *IptableRules) Init(desired []global.Messages) error {
+	if err := ir.EnsureChains(); err != nil {
+		return fmt.Errorf("创建outputGuard链失败:%v", err)
+	}
+	// 添加forward accept规则
+	if err := ir.CheckForwardAcceptRule(); err != nil {
+		return fmt.Errorf("添加forward accept规则失败:%v", err)
+	}
+	if desired == nil {
+		current, err := ir.Cache()
+		if err != nil {
+			return err
+		}
+		desired = current
+	}
+	ir.state.mutex.Lock()
+	defer ir.state.mutex.Unlock()
+	state := make(map[string]global.Messages, len(desired))
+	for _, m := range desired {
+		if _, err := ir.iptFor(m.IP); err != nil {
+			Logger.Warn(fmt.Sprintf("初始化时跳过%s:%s", m.Key(), err.Error()))
+			continue
+		}
+		state[m.Key()] = m
+	}
+	if err := ir.render(state); err != nil {
 		return err
 	}
+	ir.state.desired = state
+	return nil
+}
+
+func (ir *IptableRules) Apply(m global.Messages) error {
+	return ir.ApplyBatch([]global.Messages{m})
+}
 
-	if err := ir.Ipt.InsertUnique(ir.Table, "OUTPUT", 1, ruleSpec...); err != nil {
+/*
+ * 按顺序把消息应用到期望状态,再一次性写入
+ * 写入失败时期望状态保持不变
+ */
+func (ir *IptableRules) ApplyBatch(messages []global.Messages) error {
+	ir.state.mutex.Lock()
+	defer ir.state.mutex.Unlock()
+	desired := make(map[string]global.Messages, len(ir.state.desired)+len(messages))
+	for k, m := range ir.state.desired {
+		desired[k] = m
+	}
+	for _, m := range messages {
+		switch m.Action {
+		case global.ActionAdd:
+			desired[m.Key()] = m
+		case global.ActionDel:
+			delete(desired, m.Key())
+		default:
+			return fmt.Errorf("未知的行为:%s", m.Action)
+		}
+	}
+	if err := ir.render(desired); err != nil {
 		return err
 	}
+	ir.state.desired = desired
 	return nil
 }
 
-func (ir IptableRules) DeleteAccept(ip string) error {
-	ruleSpec := []string{"-s", ip, "-j", "ACCEPT"}
-	if err := ir.Ipt.DeleteIfExists(ir.Table, "INPUT", ruleSpec...); err != nil {
+// render 生成每个地址族自有链的完整内容并写入
+func (ir IptableRules) render(desired map[string]global.Messages) error {
+	rules, err := ir.build(desired)
+	if err != nil {
 		return err
 	}
-	if err := ir.Ipt.DeleteIfExists(ir.Table, "OUTPUT", ruleSpec...); err != nil {
-		return err
+	for _, ipt := range ir.families() {
+		if err := ir.restore(ipt, rules[ipt]); err != nil {
+			return err
+		}
 	}
-
 	return nil
 }
 
-func (ir IptableRules) GetRules() ([]string, error) {
-	inputRules, err := ir.Ipt.List(ir.Table, "INPUT")
-	if err != nil {
-		return nil, err
+// build 内网地址只放行INPUT/OUTPUT,不添加转发与伪装规则
+func (ir IptableRules) build(desired map[string]global.Messages) (map[*iptables.IPTables]chainRules, error) {
+	keys := make([]string, 0, len(desired))
+	for k := range desired {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	rules := map[*iptables.IPTables]chainRules{ir.Ipt: baseRules(false)}
+	if ir.Ipt6 != nil {
+		rules[ir.Ipt6] = baseRules(true)
+	}
+	for _, k := range keys {
+		m := desired[k]
+		ipt, err := ir.iptFor(m.IP)
+		if err != nil {
+			return nil, err
+		}
+		cr := rules[ipt]
+		specs := ir.acceptSpecs(m)
+		cr.add("INPUT", specs["INPUT"]...)
+		cr.add("OUTPUT", specs["OUTPUT"]...)
+		if m.IsLocalNet {
+			continue
+		}
+		for _, spec := range ir.forwardSpecs(m) {
+			cr.add("FORWARD", spec...)
+		}
+		for _, spec := range ir.masqueradeSpecs(m) {
+			cr.add("POSTROUTING", spec...)
+		}
 	}
+	for _, ipt := range ir.families() {
+		rules[ipt].dropAll()
+	}
+	return rules, nil
+}
 
-	outputRules, err := ir.Ipt.List(ir.Table, "OUTPUT")
+// Verify 比较实际规则与期望状态,不可用地址族的规则不参与比较
+func (ir *IptableRules) Verify(desired []global.Messages) (Drift, error) {
+	state := make(map[string]global.Messages, len(desired))
+	supported := make([]global.Messages, 0, len(desired))
+	// 与内网网段相同的条目和初始化规则重合,Cache中不返回,不参与比较
+	base := baseLocalNetKeys()
+	for _, m := range desired {
+		if _, err := ir.iptFor(m.IP); err != nil {
+			continue
+		}
+		state[m.Key()] = m
+		if base[m.Key()] {
+			continue
+		}
+		supported = append(supported, m)
+	}
+	live, err := ir.Cache()
 	if err != nil {
-		return nil, err
+		return Drift{}, err
 	}
-
-	return append(inputRules, outputRules...), nil
+	drift := diffMessages(supported, live)
+	expected, err := ir.build(state)
+	if err != nil {
+		return Drift{}, err
+	}
+	drift.Structure, err = ir.verifyChains(expected)
+	if err != nil {
+		return Drift{}, err
+	}
+	return drift, nil
 }
 
-func (ir IptableRules) extractIPsFromRule(rule string) string {
-	re := regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}(?:\/\d{1,2})?\b`)
-	matchs := re.FindStringSubmatch(rule)
-	if len(matchs) == 0 {
-		return ""
-	}
-	return matchs[0]
+// Count 统计OUTPUTGUARD-FORWARD链中每个ip的流量
+func (ir *IptableRules) Count() ([]global.ExporterData, error) {
+	return ir.countChain(ir.Table, ogChain("FORWARD"))
 }
-func (ir *IptableRules) Count(table, chain string) error {
-	rules, err := ir.Ipt.ListWithCounters(table, chain)
-	if err != nil {
-		return err
+
+func (ir *IptableRules) countChain(table, chain string) ([]global.ExporterData, error) {
+	rules := make([]string, 0)
+	for _, ipt := range ir.families() {
+		familyRules, err := ipt.ListWithCounters(table, chain)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, familyRules...)
 	}
 	uniqueRules := make(map[string]global.ExporterData)
 	var errs error
@@ -140,55 +355,64 @@ func (ir *IptableRules) Count(table, chain string) error {
 		if ge.Ip == "" {
 			continue
 		}
-		key := fmt.Sprintf("%s_%s", ge.ChainName, ge.Ip)
-		existingRule, exists := uniqueRules[key]
-		// 去除重复的规则
-		// 监控暴露规则命中的总数
-		if exists {
-			ge.Packets += existingRule.Packets
-			ge.Bytes += existingRule.Bytes
-			uniqueRules[key] = ge
-			continue
-		}
-		uniqueRules[key] = ge
-
-	}
-
-	for _, ge := range uniqueRules {
-		global.ExporterDatas <- ge
+		// 监控暴露同一ip所有规则命中的总数
+		mergeExporterData(uniqueRules, ge, counterRuleKey(rule))
 	}
 
-	return errs
+	return exporterValues(uniqueRules), errs
 }
 
+/*
+ * 解析 iptables -S -v 输出的规则,格式如:
+ * -A FORWARD -d 1.1.1.1/32 -p tcp -m multiport --dports 443 -c 10 1000 -j ACCEPT
+ * 限制源网段的规则同时匹配源地址与目的地址,不在注释的源网段中的一方为白名单地址
+ */
 func (ir IptableRules) parseRule(rule string) (global.ExporterData, error) {
 	var ge global.ExporterData
 	parts := strings.Fields(rule)
 
-	if len(parts) < 8 {
+	if len(parts) < 8 || parts[0] != "-A" {
 		return ge, nil
 	}
-	var chainType string
-	direction := parts[2]
-	chainIp := parts[3]
-	t := ""
+	var chainType, chainIp, t, packets, bytes, src, dst, sources string
+	for i := 2; i < len(parts)-1; i++ {
+		switch parts[i] {
+		case "-d":
+			dst = parts[i+1]
+		case "-s":
+			src = parts[i+1]
+		case "--comment":
+			sources = commentSources(parts[i+1])
+		case "-c":
+			if i+2 < len(parts) {
+				packets = parts[i+1]
+				bytes = parts[i+2]
+			}
+		}
+	}
+	outbound := dst != "" && (src == "" || sourceListed(sources, src))
 	switch {
-	case direction == "-d":
+	case outbound:
 		chainType = "POSTROUTING"
 		t = "OUTPUT"
-	case direction == "-s":
+		chainIp = dst
+	case src != "":
 		chainType = "FORWARD"
 		t = "INPUT"
+		chainIp = src
+	}
+	if chainIp == "" || packets == "" {
+		return ge, nil
 	}
 
-	chainPacketsFloat, ok := toFloat64(parts[5])
+	chainPacketsFloat, ok := toFloat64(packets)
 	if !ok {
-		return ge, fmt.Errorf("%s尝试转换为float64 chainPacketsFloat失败", parts[5])
+		return ge, fmt.Errorf("%s尝试转换为float64 chainPacketsFloat失败", packets)
 	}
 
-	chainBytesFloat, ok := toFloat64(parts[6])
+	chainBytesFloat, ok := toFloat64(bytes)
 	if !ok {
-		return ge, fmt.Errorf("%s尝试转换为float64 chainBytesFloat失败", parts[6])
+		return ge, fmt.Errorf("%s尝试转换为float64 chainBytesFloat失败", bytes)
 	}
 
 	ge.ChainName = chainType
@@ -200,6 +424,20 @@ func (ir IptableRules) parseRule(rule string) (global.ExporterData, error) {
 	return ge, nil
 }
 
+// counterRuleKey 去掉计数后的规则,规则存在期间保持不变
+func counterRuleKey(rule string) string {
+	parts := strings.Fields(rule)
+	spec := make([]string, 0, len(parts))
+	for i := 0; i < len(parts); i++ {
+		if parts[i] == "-c" {
+			i += 2
+			continue
+		}
+		spec = append(spec, parts[i])
+	}
+	return ruleKey(spec)
+}
+
 func toFloat64(value string) (float64, bool) {
 	result, err := strconv.ParseFloat(value, 64)
 	if err != nil {
@@ -208,69 +446,98 @@ func toFloat64(value string) (float64, bool) {
 	return result, true
 }
 
-func (ir IptableRules) Cache() ([]string, error) {
-	ipList := make([]string, 0)
-	iptablesRules, err := ir.GetRules()
-	if err != nil {
-		return ipList, err
-	}
-	for _, rule := range iptablesRules {
-		ruleIp := ir.extractIPsFromRule(rule)
-		if ruleIp != "" {
-			ipList = append(ipList, ruleIp)
+/*
+ * 当前INPUT链中由server下发的规则
+ * 初始化时添加的内网网段与ICMPv6规则不计入
+ */
+func (ir IptableRules) Cache() ([]global.Messages, error) {
+	messages := make([]global.Messages, 0)
+	base := baseLocalNetKeys()
+	for _, ipt := range ir.families() {
+		rules, err := ipt.List(ir.Table, ogChain("INPUT"))
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			message, ok := parseAcceptRule(rule)
+			if !ok || base[message.Key()] {
+				continue
+			}
+			messages = append(messages, message)
 		}
 	}
-	return ipList, nil
+	return messages, nil
 }
 
-func (ir IptableRules) AddDropAll() error {
-	dropRule := []string{"-j", "DROP"}
-
-	if err := ir.Ipt.AppendUnique(ir.Table, "INPUT", dropRule...); err != nil {
-		return err
+func sourceListed(sources, addr string) bool {
+	for _, source := range global.SplitSources(sources) {
+		if global.CanonicalAddr(source) == global.CanonicalAddr(addr) {
+			return true
+		}
 	}
+	return false
+}
 
-	if err := ir.Ipt.AppendUnique(ir.Table, "OUTPUT", dropRule...); err != nil {
-		return err
+// parseAcceptRule 将INPUT链中的ACCEPT规则还原为消息,端口范围的:还原为-
+func parseAcceptRule(rule string) (global.Messages, bool) {
+	message := global.Messages{Action: global.ActionAdd}
+	accept := false
+	parts := strings.Fields(rule)
+	for i := 0; i < len(parts)-1; i++ {
+		switch parts[i] {
+		case "-s":
+			message.IP = global.CanonicalAddr(parts[i+1])
+		case "-p":
+			message.Protocol = parts[i+1]
+		case "--sports":
+			message.Ports = strings.ReplaceAll(parts[i+1], ":", "-")
+		case "--comment":
+			message.Sources = commentSources(parts[i+1])
+		case "-j":
+			accept = parts[i+1] == "ACCEPT"
+		}
 	}
-
-	return nil
+	if !accept || message.IP == "" {
+		return message, false
+	}
+	// server端按同样的规则标记内网地址
+	message.IsLocalNet, _ = isPrivateIP(message.IP)
+	return message, true
 }
 
 func (ir IptableRules) CheckForwardAcceptRule() error {
-	forwardRules, err := ir.Ipt.List(ir.Table, "FORWARD")
-	if err != nil {
-		return err
-	}
+	for _, ipt := range ir.families() {
+		forwardRules, err := ipt.List(ir.Table, "FORWARD")
+		if err != nil {
+			return err
+		}
 
-	for _, rule := range forwardRules {
-		if strings.Contains(rule, "-P FORWARD ACCEPT") {
-			return nil
+		accepted := false
+		for _, rule := range forwardRules {
+			if strings.Contains(rule, "-P FORWARD ACCEPT") {
+				accepted = true
+				break
+			}
+		}
+		if accepted {
+			continue
 		}
-	}
 
-	forwardAcceptRule := []string{"-P", "FORWARD", "ACCEPT"}
-	if err := ir.Ipt.AppendUnique(ir.Table, "FORWARD", forwardAcceptRule...); err != nil {
-		return err
+		forwardAcceptRule := []string{"-P", "FORWARD", "ACCEPT"}
+		if err := ipt.AppendUnique(ir.Table, "FORWARD", forwardAcceptRule...); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (ir IptableRules) InitAddLocalNet() error {
-	localNet := []string{
-		"127.0.0.0/8",
-		"10.0.0.0/8",
-		"172.16.0.0/12",
-		"192.168.0.0/16",
-		"100.64.0.0/10",
-		"169.254.0.0/16",
-		"255.255.255.255/32",
-	}
-	for _, local := range localNet {
-		if err := ir.AddAccept(local); err != nil {
-			return err
-		}
+// baseLocalNetKeys 初始化时放行的内网网段
+func baseLocalNetKeys() map[string]bool {
+	nets := append(global.InternalNetworks(false), global.InternalNetworks(true)...)
+	keys := make(map[string]bool, len(nets))
+	for _, n := range nets {
+		keys[global.Messages{IP: n}.Key()] = true
 	}
-	return nil
+	return keys
 }
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"outputGuard/global"
+)
+
+/*
+ * WatchBlocked 从/dev/kmsg读取drop前记录的日志,只处理打开之后的新日志
+ * 每次read返回一条完整的日志,读取过慢被覆盖时返回EPIPE,跳过即可
+ */
+func WatchBlocked(handle func(global.BlockedFlow)) error {
+	f, err := os.Open("/dev/kmsg")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			if errors.Is(err, syscall.EPIPE) {
+				continue
+			}
+			return err
+		}
+		if flow, ok := parseBlockedLog(string(buf[:n])); ok {
+			handle(flow)
+		}
+	}
+}
+
+/*
+ * 解析LOG规则写入的内核日志,格式如:
+ * 4,1234,5678901,-;og-blocked:IN=eth0 OUT=eth1 SRC=10.0.0.5 DST=1.2.3.4 LEN=60 ... PROTO=TCP SPT=5000 DPT=443 ...
+ * 目的地址为内网地址的不是出网访问,忽略
+ */
+func parseBlockedLog(line string) (global.BlockedFlow, bool) {
+	flow := global.BlockedFlow{Count: 1, LastSeen: time.Now()}
+	i := strings.Index(line, global.BlockedLogPrefix)
+	if i < 0 {
+		return flow, false
+	}
+	for _, field := range strings.Fields(line[i+len(global.BlockedLogPrefix):]) {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "SRC":
+			flow.Source = global.CanonicalAddr(value)
+		case "DST":
+			flow.IP = global.CanonicalAddr(value)
+		case "PROTO":
+			flow.Protocol = strings.ToLower(value)
+		case "DPT":
+			flow.Port, _ = strconv.Atoi(value)
+		}
+	}
+	if flow.Source == "" || flow.IP == "" {
+		return flow, false
+	}
+	if local, err := isPrivateIP(flow.IP); err != nil || local {
+		return flow, false
+	}
+	return flow, true
+}
@@ -0,0 +1,832 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"outputGuard/global"
+	. "outputGuard/logger"
+)
+
+/*
+ * nftables后端,所有规则在独立的inet outputguard表中,通过nft -f执行
+ * 每种协议/端口组合(spec)对应:
+ *   out4_<spec>/out6_<spec>     放行的目的地址
+ *   local4_<spec>/local6_<spec> 内网地址,只放行input/output
+ *   co4_<spec>/ci4_<spec>       地址 -> 命名计数器,分别统计出网与回包方向
+ * 链中的规则由已有的spec生成,新增spec时整体重新生成,集合与计数器不受影响
+ * interval集合中的元素不能重叠,被同一集合中其他网段覆盖的地址不写入,流量计入覆盖它的网段
+ */
+const (
+	nftTable     = "outputguard"
+	nftTableSpec = "inet " + nftTable
+)
+
+type NftRules struct {
+	mutex sync.Mutex
+	// spec -> 协议/端口
+	specs map[string]global.Messages
+	// 集合名 -> 期望的地址,包括被其他网段覆盖、未写入集合的地址
+	addrs map[string]map[string]bool
+}
+
+func NewNftRules() (*NftRules, error) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil, fmt.Errorf("未找到nft命令:%v", err)
+	}
+	return &NftRules{specs: make(map[string]global.Messages), addrs: make(map[string]map[string]bool)}, nil
+}
+
+func (nr *NftRules) IPv6() bool {
+	return true
+}
+
+// Uninstall 删除outputguard表
+func (nr *NftRules) Uninstall() error {
+	nr.mutex.Lock()
+	defer nr.mutex.Unlock()
+	if err := runNft(fmt.Sprintf("delete table %s\n", nftTableSpec)); err != nil && !nftMissing(err) {
+		return err
+	}
+	nr.specs = make(map[string]global.Messages)
+	nr.addrs = make(map[string]map[string]bool)
+	Logger.Info(fmt.Sprintf("已删除nftables表%s", nftTableSpec))
+	return nil
+}
+
+// 源网段编码在集合名中,集合名只能包含字母、数字与下划线
+var (
+	nftSourceEncoder = strings.NewReplacer(".", "p", "/", "m", ":", "x", ",", "_")
+	nftSourceDecoder = strings.NewReplacer("p", ".", "m", "/", "x", ":", "_", ",")
+)
+
+/*
+ * nftSpecID 协议/端口/源网段编码在集合名中,重启后可以从集合名还原
+ * 源网段与协议/端口之间以__分隔,名字长度由global中源网段与端口的上限保证
+ */
+func nftSpecID(m global.Messages) string {
+	id := "all"
+	if m.Protocol != "" && m.Ports == "" {
+		id = m.Protocol
+	} else if m.Protocol != "" {
+		id = m.Protocol + "_" + strings.NewReplacer(",", "_", "-", "t").Replace(m.Ports)
+	}
+	if m.Sources == "" {
+		return id
+	}
+	return id + "__" + nftSourceEncoder.Replace(m.Sources)
+}
+
+func nftSpecFromID(id string) global.Messages {
+	spec := global.Messages{Action: global.ActionAdd}
+	if i := strings.Index(id, "__"); i >= 0 {
+		spec.Sources = nftSourceDecoder.Replace(id[i+2:])
+		id = id[:i]
+	}
+	if id == "all" {
+		return spec
+	}
+	parts := strings.SplitN(id, "_", 2)
+	spec.Protocol = parts[0]
+	if len(parts) == 2 {
+		spec.Ports = strings.NewReplacer("_", ",", "t", "-").Replace(parts[1])
+	}
+	return spec
+}
+
+// nftSetName 消息的地址所在的集合
+func nftSetName(m global.Messages) string {
+	set := "out"
+	if m.IsLocalNet {
+		set = "local"
+	}
+	return set + nftFamily(m.IP) + "_" + nftSpecID(m)
+}
+
+// nftSetMessage 由集合名与元素还原消息
+func nftSetMessage(name, addr string) global.Messages {
+	id, _ := nftSetSpec(name)
+	m := nftSpecFromID(id)
+	m.IP = addr
+	m.IsLocalNet = strings.HasPrefix(name, "local")
+	return m
+}
+
+/*
+ * nftCovering 同一集合中的地址 -> 覆盖它的最大网段,未被覆盖时为自身
+ * 按前缀从短到长处理,每个地址归到第一个包含它的网段
+ */
+func nftCovering(addrs []string) map[string]string {
+	type prefix struct {
+		addr string
+		net  *net.IPNet
+		ones int
+	}
+	prefixes := make([]prefix, 0, len(addrs))
+	covering := make(map[string]string, len(addrs))
+	for _, addr := range addrs {
+		nets, err := global.ParseNets([]string{addr})
+		if err != nil {
+			covering[addr] = addr
+			continue
+		}
+		ones, _ := nets[0].Mask.Size()
+		prefixes = append(prefixes, prefix{addr: addr, net: nets[0], ones: ones})
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].ones != prefixes[j].ones {
+			return prefixes[i].ones < prefixes[j].ones
+		}
+		return prefixes[i].addr < prefixes[j].addr
+	})
+	roots := make([]prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		covering[p.addr] = p.addr
+		for _, root := range roots {
+			if len(root.net.IP) == len(p.net.IP) && root.net.Contains(p.net.IP) {
+				covering[p.addr] = root.addr
+				break
+			}
+		}
+		if covering[p.addr] == p.addr {
+			roots = append(roots, p)
+		}
+	}
+	return covering
+}
+
+/*
+ * syncElements 使集合中的元素与期望的地址一致,调用方需持有mutex
+ * 只删除当前存在的元素,nft -f中删除不存在的元素会导致整个事务失败
+ */
+func (nr *NftRules) syncElements(script *strings.Builder, live map[string][]string, names []string) {
+	sort.Strings(names)
+	for _, name := range names {
+		addrs := make([]string, 0, len(nr.addrs[name]))
+		for addr := range nr.addrs[name] {
+			addrs = append(addrs, addr)
+		}
+		want := make(map[string]bool, len(addrs))
+		for _, root := range nftCovering(addrs) {
+			want[root] = true
+		}
+		have := make(map[string]bool, len(live[name]))
+		for _, addr := range live[name] {
+			have[global.CanonicalAddr(addr)] = true
+		}
+		// 先删除再添加,被新网段覆盖的地址删除后网段才能写入
+		for _, addr := range sortedKeys(have) {
+			if want[addr] {
+				continue
+			}
+			for _, line := range nftDelElements(nftSetMessage(name, addr)) {
+				script.WriteString(line + "\n")
+			}
+		}
+		for _, addr := range sortedKeys(want) {
+			if !have[addr] {
+				nftAddElements(script, nftSetMessage(name, addr))
+			}
+		}
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// trackAddr 记录或移除期望的地址,返回所在的集合名
+func (nr *NftRules) trackAddr(m global.Messages) string {
+	name := nftSetName(m)
+	addr := global.CanonicalAddr(m.IP)
+	if m.Action == global.ActionDel {
+		delete(nr.addrs[name], addr)
+		if len(nr.addrs[name]) == 0 {
+			delete(nr.addrs, name)
+		}
+		return name
+	}
+	if nr.addrs[name] == nil {
+		nr.addrs[name] = make(map[string]bool)
+	}
+	nr.addrs[name][addr] = true
+	return name
+}
+
+func nftFamily(addr string) string {
+	if isIPv6(addr) {
+		return "6"
+	}
+	return "4"
+}
+
+var nftNameReplacer = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// nftCounterName 计数器名,dir为o(出网)或i(回包)
+func nftCounterName(dir, id, addr string) string {
+	return fmt.Sprintf("%s_%s_%s", dir, id, nftNameReplacer.ReplaceAllString(addr, "_"))
+}
+
+func nftPortMatch(m global.Messages, toDest bool) string {
+	if m.Protocol == "" {
+		return ""
+	}
+	if m.Ports == "" {
+		return "meta l4proto " + m.Protocol + " "
+	}
+	dir := "sport"
+	if toDest {
+		dir = "dport"
+	}
+	return fmt.Sprintf("%s %s { %s } ", m.Protocol, dir, strings.ReplaceAll(m.Ports, ",", ", "))
+}
+
+/*
+ * Init 创建表、基础链与计数用的map,重新生成链中的规则
+ * desired中的地址与链在同一个事务中写入
+ */
+func (nr *NftRules) Init(desired []global.Messages) error {
+	nr.mutex.Lock()
+	defer nr.mutex.Unlock()
+	state, err := nftListTable()
+	if err != nil {
+		return err
+	}
+	// 只保留仍然存在的集合,被删除的spec在收到消息时重新创建
+	nr.specs = make(map[string]global.Messages)
+	for name := range state.sets {
+		if id, ok := nftSetSpec(name); ok {
+			nr.specs[id] = nftSpecFromID(id)
+		}
+	}
+	var script strings.Builder
+	fmt.Fprintf(&script, "add table %s\n", nftTableSpec)
+	fmt.Fprintf(&script, "add chain %s input { type filter hook input priority 0; policy drop; }\n", nftTableSpec)
+	fmt.Fprintf(&script, "add chain %s output { type filter hook output priority 0; policy drop; }\n", nftTableSpec)
+	fmt.Fprintf(&script, "add chain %s forward { type filter hook forward priority 0; policy accept; }\n", nftTableSpec)
+	fmt.Fprintf(&script, "add chain %s postrouting { type nat hook postrouting priority 100; policy accept; }\n", nftTableSpec)
+	nr.addrs = make(map[string]map[string]bool)
+	names := make([]string, 0)
+	for _, m := range desired {
+		m.Action = global.ActionAdd
+		nr.ensure(&script, m)
+		if _, ok := nr.addrs[nftSetName(m)]; !ok {
+			names = append(names, nftSetName(m))
+		}
+		nr.trackAddr(m)
+	}
+	var elements strings.Builder
+	nr.syncElements(&elements, state.sets, names)
+	nr.renderChains(&script)
+	script.WriteString(elements.String())
+	return runNft(script.String())
+}
+
+// nftSetSpec 从集合名取出spec
+func nftSetSpec(name string) (string, bool) {
+	for _, prefix := range []string{"out4_", "out6_", "local4_", "local6_"} {
+		if strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix), true
+		}
+	}
+	return "", false
+}
+
+/*
+ * 重新生成链中的规则
+ * 内网网段的放行规则与iptables后端一致,output同时匹配源地址与目的地址
+ */
+func (nr *NftRules) renderChains(script *strings.Builder) {
+	for _, chain := range []string{"input", "output", "forward", "postrouting"} {
+		fmt.Fprintf(script, "flush chain %s %s\n", nftTableSpec, chain)
+	}
+	local4 := strings.Join(global.InternalNetworks(false), ", ")
+	local6 := strings.Join(global.InternalNetworks(true), ", ")
+	fmt.Fprintf(script, "add rule %s input ip saddr { %s } accept\n", nftTableSpec, local4)
+	fmt.Fprintf(script, "add rule %s input ip6 saddr { %s } accept\n", nftTableSpec, local6)
+	fmt.Fprintf(script, "add rule %s output ip saddr { %s } accept\n", nftTableSpec, local4)
+	fmt.Fprintf(script, "add rule %s output ip daddr { %s } accept\n", nftTableSpec, local4)
+	fmt.Fprintf(script, "add rule %s output ip6 daddr { %s } accept\n", nftTableSpec, local6)
+	// 邻居发现依赖ICMPv6
+	fmt.Fprintf(script, "add rule %s input meta l4proto ipv6-icmp accept\n", nftTableSpec)
+	fmt.Fprintf(script, "add rule %s output meta l4proto ipv6-icmp accept\n", nftTableSpec)
+
+	ids := make([]string, 0, len(nr.specs))
+	for id := range nr.specs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		spec := nr.specs[id]
+		dports := nftPortMatch(spec, true)
+		sports := nftPortMatch(spec, false)
+		for _, f := range []string{"4", "6"} {
+			ip := "ip"
+			if f == "6" {
+				ip = "ip6"
+			}
+			out := fmt.Sprintf("@out%s_%s", f, id)
+			local := fmt.Sprintf("@local%s_%s", f, id)
+			fmt.Fprintf(script, "add rule %s input %s saddr %s %saccept\n", nftTableSpec, ip, out, sports)
+			fmt.Fprintf(script, "add rule %s input %s saddr %s %saccept\n", nftTableSpec, ip, local, sports)
+			fmt.Fprintf(script, "add rule %s output %s daddr %s %saccept\n", nftTableSpec, ip, out, dports)
+			fmt.Fprintf(script, "add rule %s output %s daddr %s %saccept\n", nftTableSpec, ip, local, dports)
+			// 限制源网段时只转发来自源网段的流量,源网段都不属于该地址族时不转发
+			fromSources, toSources := "", ""
+			if spec.Sources != "" {
+				sources := spec.SourcesFor(f == "6")
+				if len(sources) == 0 {
+					continue
+				}
+				set := strings.Join(sources, ", ")
+				fromSources = fmt.Sprintf("%s saddr { %s } ", ip, set)
+				toSources = fmt.Sprintf("%s daddr { %s } ", ip, set)
+			}
+			fmt.Fprintf(script, "add rule %s forward %s%s daddr %s %scounter name %s daddr map @co%s_%s accept\n", nftTableSpec, fromSources, ip, out, dports, ip, f, id)
+			fmt.Fprintf(script, "add rule %s forward %s%s saddr %s %scounter name %s saddr map @ci%s_%s accept\n", nftTableSpec, toSources, ip, out, sports, ip, f, id)
+			fmt.Fprintf(script, "add rule %s postrouting %s%s daddr %s %smasquerade\n", nftTableSpec, fromSources, ip, out, dports)
+		}
+	}
+	// 与iptables后端相同,被拦截的新建连接限速写入内核日志
+	for _, chain := range []string{"forward", "output"} {
+		fmt.Fprintf(script, "add rule %s %s ct state new limit rate 20/second burst 100 packets log prefix \"%s\"\n", nftTableSpec, chain, global.BlockedLogPrefix)
+	}
+}
+
+// ensure 新的spec创建集合与map后重新生成链,调用方需持有mutex
+func (nr *NftRules) ensure(script *strings.Builder, m global.Messages) bool {
+	id := nftSpecID(m)
+	if _, ok := nr.specs[id]; ok {
+		return false
+	}
+	nr.specs[id] = nftSpecFromID(id)
+	for _, f := range []string{"4", "6"} {
+		addrType := "ipv4_addr"
+		if f == "6" {
+			addrType = "ipv6_addr"
+		}
+		for _, set := range []string{"out", "local"} {
+			fmt.Fprintf(script, "add set %s %s%s_%s { type %s; flags interval; }\n", nftTableSpec, set, f, id, addrType)
+		}
+		for _, dir := range []string{"co", "ci"} {
+			fmt.Fprintf(script, "add map %s %s%s_%s { type %s : counter; flags interval; }\n", nftTableSpec, dir, f, id, addrType)
+		}
+	}
+	return true
+}
+
+func nftAddElements(script *strings.Builder, m global.Messages) {
+	id, f := nftSpecID(m), nftFamily(m.IP)
+	if m.IsLocalNet {
+		fmt.Fprintf(script, "add element %s local%s_%s { %s }\n", nftTableSpec, f, id, m.IP)
+		return
+	}
+	out, in := nftCounterName("o", id, m.IP), nftCounterName("i", id, m.IP)
+	fmt.Fprintf(script, "add counter %s %s\n", nftTableSpec, out)
+	fmt.Fprintf(script, "add counter %s %s\n", nftTableSpec, in)
+	fmt.Fprintf(script, "add element %s out%s_%s { %s }\n", nftTableSpec, f, id, m.IP)
+	fmt.Fprintf(script, "add element %s co%s_%s { %s : \"%s\" }\n", nftTableSpec, f, id, m.IP, out)
+	fmt.Fprintf(script, "add element %s ci%s_%s { %s : \"%s\" }\n", nftTableSpec, f, id, m.IP, in)
+}
+
+// nftDelElements 计数器被map引用,需先删除map中的元素
+func nftDelElements(m global.Messages) []string {
+	id, f := nftSpecID(m), nftFamily(m.IP)
+	if m.IsLocalNet {
+		return []string{fmt.Sprintf("delete element %s local%s_%s { %s }", nftTableSpec, f, id, m.IP)}
+	}
+	return []string{
+		fmt.Sprintf("delete element %s co%s_%s { %s }", nftTableSpec, f, id, m.IP),
+		fmt.Sprintf("delete element %s ci%s_%s { %s }", nftTableSpec, f, id, m.IP),
+		fmt.Sprintf("delete counter %s %s", nftTableSpec, nftCounterName("o", id, m.IP)),
+		fmt.Sprintf("delete counter %s %s", nftTableSpec, nftCounterName("i", id, m.IP)),
+		fmt.Sprintf("delete element %s out%s_%s { %s }", nftTableSpec, f, id, m.IP),
+	}
+}
+
+func (nr *NftRules) Apply(m global.Messages) error {
+	return nr.ApplyBatch([]global.Messages{m})
+}
+
+/*
+ * 一批消息在一次nft -f中完成
+ * 只重新计算消息涉及的集合,失败时恢复这些集合期望的地址
+ */
+func (nr *NftRules) ApplyBatch(messages []global.Messages) error {
+	for _, m := range messages {
+		if m.Action != global.ActionAdd && m.Action != global.ActionDel {
+			return fmt.Errorf("未知的行为:%s", m.Action)
+		}
+	}
+	state, err := nftListTable()
+	if err != nil {
+		return err
+	}
+
+	nr.mutex.Lock()
+	defer nr.mutex.Unlock()
+	var script, elements strings.Builder
+	newSpecs := make([]string, 0)
+	saved := make(map[string]map[string]bool)
+	names := make([]string, 0)
+	for _, m := range messages {
+		name := nftSetName(m)
+		if _, ok := saved[name]; !ok {
+			saved[name] = copyAddrs(nr.addrs[name])
+			names = append(names, name)
+		}
+		if m.Action == global.ActionAdd && nr.ensure(&script, m) {
+			newSpecs = append(newSpecs, nftSpecID(m))
+		}
+		nr.trackAddr(m)
+	}
+	nr.syncElements(&elements, state.sets, names)
+	if len(newSpecs) > 0 {
+		nr.renderChains(&script)
+	}
+	script.WriteString(elements.String())
+	if script.Len() == 0 {
+		return nil
+	}
+	if err := runNft(script.String()); err != nil {
+		// 新spec创建失败时下次重新创建
+		for _, id := range newSpecs {
+			delete(nr.specs, id)
+		}
+		for name, addrs := range saved {
+			if len(addrs) == 0 {
+				delete(nr.addrs, name)
+			} else {
+				nr.addrs[name] = addrs
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func copyAddrs(addrs map[string]bool) map[string]bool {
+	copied := make(map[string]bool, len(addrs))
+	for addr := range addrs {
+		copied[addr] = true
+	}
+	return copied
+}
+
+// Reconcile 删除与添加在一次nft -f中完成
+func (nr *NftRules) Reconcile(desired []global.Messages) (added, removed int, err error) {
+	current, err := nr.Cache()
+	if err != nil {
+		return 0, 0, err
+	}
+	state, err := nftListTable()
+	if err != nil {
+		return 0, 0, err
+	}
+	currentKeys := make(map[string]bool, len(current))
+	for _, m := range current {
+		currentKeys[m.Key()] = true
+	}
+	desiredKeys := make(map[string]bool, len(desired))
+	for _, m := range desired {
+		desiredKeys[m.Key()] = true
+	}
+	for _, m := range current {
+		if !desiredKeys[m.Key()] {
+			removed++
+			Logger.Info(fmt.Sprintf("对齐时删除server端已不存在的规则:%s", m.Key()))
+		}
+	}
+
+	nr.mutex.Lock()
+	defer nr.mutex.Unlock()
+	saved := nr.addrs
+	nr.addrs = make(map[string]map[string]bool)
+	var script, elements strings.Builder
+	newSpecs := make([]string, 0)
+	for _, m := range desired {
+		m.Action = global.ActionAdd
+		if nr.ensure(&script, m) {
+			newSpecs = append(newSpecs, nftSpecID(m))
+		}
+		nr.trackAddr(m)
+		if !currentKeys[m.Key()] {
+			added++
+		}
+	}
+	// 已不在期望状态中的集合也需要清空
+	names := make([]string, 0, len(state.sets))
+	for name := range state.sets {
+		if _, ok := nftSetSpec(name); ok {
+			names = append(names, name)
+		}
+	}
+	for name := range nr.addrs {
+		if _, ok := state.sets[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	nr.syncElements(&elements, state.sets, names)
+	if len(newSpecs) > 0 {
+		nr.renderChains(&script)
+	}
+	script.WriteString(elements.String())
+	if script.Len() == 0 {
+		return added, removed, nil
+	}
+	if err := runNft(script.String()); err != nil {
+		for _, id := range newSpecs {
+			delete(nr.specs, id)
+		}
+		nr.addrs = saved
+		return 0, 0, err
+	}
+	return added, removed, nil
+}
+
+/*
+ * Verify 比较集合中的元素与期望状态
+ * 链的规则数与按已有spec生成的规则数不一致,或spec对应的集合缺失时视为结构异常
+ */
+func (nr *NftRules) Verify(desired []global.Messages) (Drift, error) {
+	state, err := nftListTable()
+	if err != nil {
+		return Drift{}, err
+	}
+	live, err := nr.Cache()
+	if err != nil {
+		return Drift{}, err
+	}
+	drift := diffMessages(desired, live)
+
+	nr.mutex.Lock()
+	defer nr.mutex.Unlock()
+	ids := make([]string, 0, len(nr.specs))
+	for id := range nr.specs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, f := range []string{"4", "6"} {
+			for _, set := range []string{"out", "local"} {
+				if _, ok := state.sets[set+f+"_"+id]; !ok {
+					drift.Structure = append(drift.Structure, fmt.Sprintf("nftables集合%s%s_%s不存在", set, f, id))
+				}
+			}
+			for _, dir := range []string{"co", "ci"} {
+				if _, ok := state.maps[dir+f+"_"+id]; !ok {
+					drift.Structure = append(drift.Structure, fmt.Sprintf("nftables map %s%s_%s不存在", dir, f, id))
+				}
+			}
+		}
+	}
+	var script strings.Builder
+	nr.renderChains(&script)
+	for _, chain := range []string{"input", "output", "forward", "postrouting"} {
+		want := strings.Count(script.String(), fmt.Sprintf("add rule %s %s ", nftTableSpec, chain))
+		got, ok := state.chains[chain]
+		if !ok {
+			drift.Structure = append(drift.Structure, fmt.Sprintf("nftables链%s不存在", chain))
+			continue
+		}
+		if got != want {
+			drift.Structure = append(drift.Structure, fmt.Sprintf("nftables链%s的规则与期望不一致,期望%d条,实际%d条", chain, want, got))
+		}
+	}
+	return drift, nil
+}
+
+/*
+ * Cache 集合中的元素,协议/端口从集合名还原
+ * 被集合中的网段覆盖而未写入的期望地址视为已生效
+ */
+func (nr *NftRules) Cache() ([]global.Messages, error) {
+	state, err := nftListTable()
+	if err != nil {
+		return nil, err
+	}
+	nr.mutex.Lock()
+	defer nr.mutex.Unlock()
+	messages := make([]global.Messages, 0)
+	for name, elems := range state.sets {
+		if _, ok := nftSetSpec(name); !ok {
+			continue
+		}
+		have := make(map[string]bool, len(elems))
+		for _, addr := range elems {
+			have[global.CanonicalAddr(addr)] = true
+			messages = append(messages, nftSetMessage(name, global.CanonicalAddr(addr)))
+		}
+		addrs := make([]string, 0, len(nr.addrs[name]))
+		for addr := range nr.addrs[name] {
+			addrs = append(addrs, addr)
+		}
+		for addr, root := range nftCovering(addrs) {
+			if addr != root && !have[addr] && have[root] {
+				messages = append(messages, nftSetMessage(name, addr))
+			}
+		}
+	}
+	return messages, nil
+}
+
+// Count co/ci对应iptables后端的POSTROUTING/FORWARD标签
+func (nr *NftRules) Count() ([]global.ExporterData, error) {
+	state, err := nftListTable()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	uniqueRules := make(map[string]global.ExporterData)
+	for name, elems := range state.maps {
+		chain, direction := "POSTROUTING", "OUTPUT"
+		switch {
+		case strings.HasPrefix(name, "co"):
+		case strings.HasPrefix(name, "ci"):
+			chain, direction = "FORWARD", "INPUT"
+		default:
+			continue
+		}
+		for addr, counterName := range elems {
+			c, ok := state.counters[counterName]
+			if !ok {
+				continue
+			}
+			ge := global.ExporterData{
+				ChainName: chain,
+				Direction: direction,
+				Ip:        global.ExporterAddr(addr),
+				Packets:   c.Packets,
+				Bytes:     c.Bytes,
+				Hostname:  hostname,
+			}
+			mergeExporterData(uniqueRules, ge, counterName)
+		}
+	}
+	return exporterValues(uniqueRules), nil
+}
+
+type nftCounter struct {
+	Packets float64 `json:"packets"`
+	Bytes   float64 `json:"bytes"`
+}
+
+type nftState struct {
+	sets     map[string][]string
+	maps     map[string]map[string]string
+	counters map[string]nftCounter
+	// 链名 -> 规则数
+	chains map[string]int
+}
+
+type nftSetJSON struct {
+	Name string            `json:"name"`
+	Map  string            `json:"map"`
+	Elem []json.RawMessage `json:"elem"`
+}
+
+type nftCounterJSON struct {
+	Name    string  `json:"name"`
+	Packets float64 `json:"packets"`
+	Bytes   float64 `json:"bytes"`
+}
+
+/*
+ * 解析nft -j list table的输出
+ * 表不存在时返回空状态
+ */
+func nftListTable() (*nftState, error) {
+	state := &nftState{
+		sets:     make(map[string][]string),
+		maps:     make(map[string]map[string]string),
+		counters: make(map[string]nftCounter),
+		chains:   make(map[string]int),
+	}
+	out, err := nftOutput("-j", "list", "table", "inet", nftTable)
+	if err != nil {
+		if nftMissing(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	var doc struct {
+		Nftables []struct {
+			Set     *nftSetJSON     `json:"set"`
+			Map     *nftSetJSON     `json:"map"`
+			Counter *nftCounterJSON `json:"counter"`
+			Chain   *struct {
+				Name string `json:"name"`
+			} `json:"chain"`
+			Rule *struct {
+				Chain string `json:"chain"`
+			} `json:"rule"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(out, &doc); err != nil {
+		return nil, fmt.Errorf("解析nft输出失败:%v", err)
+	}
+	for _, obj := range doc.Nftables {
+		switch {
+		case obj.Set != nil:
+			elems := make([]string, 0, len(obj.Set.Elem))
+			for _, raw := range obj.Set.Elem {
+				if addr := nftElemAddr(raw); addr != "" {
+					elems = append(elems, addr)
+				}
+			}
+			state.sets[obj.Set.Name] = elems
+		case obj.Map != nil:
+			elems := make(map[string]string, len(obj.Map.Elem))
+			for _, raw := range obj.Map.Elem {
+				var pair []json.RawMessage
+				if err := json.Unmarshal(raw, &pair); err != nil || len(pair) != 2 {
+					continue
+				}
+				var counterName string
+				if err := json.Unmarshal(pair[1], &counterName); err != nil {
+					continue
+				}
+				if addr := nftElemAddr(pair[0]); addr != "" {
+					elems[addr] = counterName
+				}
+			}
+			state.maps[obj.Map.Name] = elems
+		case obj.Counter != nil:
+			state.counters[obj.Counter.Name] = nftCounter{Packets: obj.Counter.Packets, Bytes: obj.Counter.Bytes}
+		case obj.Chain != nil:
+			if _, ok := state.chains[obj.Chain.Name]; !ok {
+				state.chains[obj.Chain.Name] = 0
+			}
+		case obj.Rule != nil:
+			state.chains[obj.Rule.Chain]++
+		}
+	}
+	return state, nil
+}
+
+// nftElemAddr 元素为地址字符串或{"prefix":{"addr":..,"len":..}}
+func nftElemAddr(raw json.RawMessage) string {
+	var addr string
+	if err := json.Unmarshal(raw, &addr); err == nil {
+		return addr
+	}
+	var elem struct {
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+		Elem *struct {
+			Val json.RawMessage `json:"val"`
+		} `json:"elem"`
+	}
+	if err := json.Unmarshal(raw, &elem); err != nil {
+		return ""
+	}
+	if elem.Prefix != nil {
+		return fmt.Sprintf("%s/%d", elem.Prefix.Addr, elem.Prefix.Len)
+	}
+	if elem.Elem != nil {
+		return nftElemAddr(elem.Elem.Val)
+	}
+	return ""
+}
+
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft -f失败:%v:%s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func nftOutput(args ...string) ([]byte, error) {
+	cmd := exec.Command("nft", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("nft %s失败:%v:%s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// nftMissing 表、集合或元素不存在
+func nftMissing(err error) bool {
+	return strings.Contains(err.Error(), "No such file or directory")
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNftCovering(t *testing.T) {
+	covering := nftCovering([]string{"1.2.3.4", "1.2.3.0/24", "1.2.0.0/16", "5.6.7.8", "2001:db8::1", "2001:db8::/32"})
+	want := map[string]string{
+		"1.2.3.4":       "1.2.0.0/16",
+		"1.2.3.0/24":    "1.2.0.0/16",
+		"1.2.0.0/16":    "1.2.0.0/16",
+		"5.6.7.8":       "5.6.7.8",
+		"2001:db8::1":   "2001:db8::/32",
+		"2001:db8::/32": "2001:db8::/32",
+	}
+	for addr, root := range want {
+		if covering[addr] != root {
+			t.Errorf("%s: 期望被%s覆盖,实际为%s", addr, root, covering[addr])
+		}
+	}
+}
+
+// 同一集合中同时有网段与网段内的ip时只写入网段,已存在的ip先删除
+func TestNftSyncElementsOverlap(t *testing.T) {
+	nr := &NftRules{addrs: map[string]map[string]bool{
+		"out4_all": {"1.2.3.0/24": true, "1.2.3.4": true},
+	}}
+
+	var script strings.Builder
+	nr.syncElements(&script, map[string][]string{}, []string{"out4_all"})
+	if !strings.Contains(script.String(), "add element inet outputguard out4_all { 1.2.3.0/24 }") {
+		t.Fatalf("未写入网段:\n%s", script.String())
+	}
+	if strings.Contains(script.String(), "1.2.3.4") {
+		t.Fatalf("写入了被网段覆盖的ip:\n%s", script.String())
+	}
+
+	script.Reset()
+	nr.syncElements(&script, map[string][]string{"out4_all": {"1.2.3.4"}}, []string{"out4_all"})
+	out := script.String()
+	del := strings.Index(out, "delete element inet outputguard out4_all { 1.2.3.4 }")
+	add := strings.Index(out, "add element inet outputguard out4_all { 1.2.3.0/24 }")
+	if del < 0 || add < 0 || del > add {
+		t.Fatalf("应先删除ip再写入网段:\n%s", out)
+	}
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"fmt"
+
+	"outputGuard/global"
+	. "outputGuard/logger"
+)
+
+/*
+ * 按server下发的快照对齐本机规则
+ * 快照即为完整的期望状态,一次性写入,与当前规则比较只用于统计
+ */
+func (ir *IptableRules) Reconcile(desired []global.Messages) (added, removed int, err error) {
+	current, err := ir.Cache()
+	if err != nil {
+		return 0, 0, err
+	}
+	currentKeys := make(map[string]bool, len(current))
+	for _, m := range current {
+		currentKeys[m.Key()] = true
+	}
+	state := make(map[string]global.Messages, len(desired))
+	failed := 0
+	for _, m := range desired {
+		if _, err := ir.iptFor(m.IP); err != nil {
+			failed++
+			Logger.Error(fmt.Sprintf("对齐时跳过%s:%s", m.Key(), err.Error()))
+			continue
+		}
+		state[m.Key()] = m
+		if !currentKeys[m.Key()] {
+			added++
+		}
+	}
+	for _, m := range current {
+		if _, ok := state[m.Key()]; !ok {
+			removed++
+			Logger.Info(fmt.Sprintf("对齐时删除server端已不存在的规则:%s", m.Key()))
+		}
+	}
+
+	ir.state.mutex.Lock()
+	defer ir.state.mutex.Unlock()
+	if err := ir.render(state); err != nil {
+		return 0, 0, err
+	}
+	ir.state.desired = state
+	if failed > 0 {
+		return added, removed, fmt.Errorf("%d条规则对齐失败", failed)
+	}
+	return added, removed, nil
+}
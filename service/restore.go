@@ -0,0 +1,169 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"outputGuard/global"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// chainRules 自有链的完整内容,key为去掉前缀的自有链名,规则按顺序排列
+type chainRules map[string][][]string
+
+func (cr chainRules) add(builtin string, spec ...string) {
+	cr[builtin] = append(cr[builtin], spec)
+}
+
+/*
+ * 基础规则:放行内网网段,IPv6放行ICMPv6
+ * 内网网段沿用旧版本的规则,INPUT/OUTPUT都匹配源地址
+ */
+func baseRules(v6 bool) chainRules {
+	rules := chainRules{}
+	localNet := global.InternalNetworks(v6)
+	if v6 {
+		// 邻居发现依赖ICMPv6,不放行会导致IPv6无法通信
+		rules.add("INPUT", "-p", "ipv6-icmp", "-j", "ACCEPT")
+		rules.add("OUTPUT", "-p", "ipv6-icmp", "-j", "ACCEPT")
+	}
+	for _, local := range localNet {
+		rules.add("INPUT", "-s", local, "-j", "ACCEPT")
+		rules.add("OUTPUT", "-s", local, "-j", "ACCEPT")
+	}
+	return rules
+}
+
+// 被拦截的新建连接限速写入内核日志,由gateway读取后上报
+var blockedLogSpec = []string{
+	"-m", "conntrack", "--ctstate", "NEW",
+	"-m", "limit", "--limit", "20/sec", "--limit-burst", "100",
+	"-j", "LOG", "--log-prefix", global.BlockedLogPrefix,
+}
+
+/*
+ * dropAll drop规则在内置链末尾跳转的drop链中,白名单链不含drop
+ * 没有匹配白名单的转发与出网连接在drop前记录日志,转发的连接不伪装,同样无法出网
+ */
+func (cr chainRules) dropAll() {
+	cr.add("FORWARD", blockedLogSpec...)
+	cr.add("OUTPUT-DROP", blockedLogSpec...)
+	cr.add("INPUT-DROP", "-j", "DROP")
+	cr.add("OUTPUT-DROP", "-j", "DROP")
+}
+
+/*
+ * 通过一次iptables-restore --noflush替换所有自有链的内容
+ * 声明的自有链会被清空后重新写入,内置链与其他程序的规则不受影响
+ * 已有规则的计数沿用,避免每次应用后流量统计归零
+ */
+func (ir IptableRules) restore(ipt *iptables.IPTables, rules chainRules) error {
+	counters, err := ir.chainCounters(ipt)
+	if err != nil {
+		return err
+	}
+	var script strings.Builder
+	for _, table := range []string{"filter", "nat"} {
+		fmt.Fprintf(&script, "*%s\n", table)
+		for _, c := range managedChains {
+			if c.table == table {
+				fmt.Fprintf(&script, ":%s - [0:0]\n", ogChain(c.name))
+			}
+		}
+		for _, c := range managedChains {
+			if c.table != table {
+				continue
+			}
+			for _, spec := range rules[c.name] {
+				counter := counters[ogChain(c.name)+" "+ruleKey(spec)]
+				if counter == "" {
+					counter = "[0:0]"
+				}
+				fmt.Fprintf(&script, "%s -A %s %s\n", counter, ogChain(c.name), strings.Join(spec, " "))
+			}
+		}
+		script.WriteString("COMMIT\n")
+	}
+	return runRestore(ipt, script.String())
+}
+
+// chainCounters 自有链中已有规则的计数,格式为[packets:bytes]
+func (ir IptableRules) chainCounters(ipt *iptables.IPTables) (map[string]string, error) {
+	counters := make(map[string]string)
+	for _, c := range managedChains {
+		chain := ogChain(c.name)
+		exists, err := ipt.ChainExists(c.table, chain)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		rules, err := ipt.ListWithCounters(c.table, chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			parts := strings.Fields(rule)
+			if len(parts) < 3 || parts[0] != "-A" {
+				continue
+			}
+			spec := make([]string, 0, len(parts))
+			counter := ""
+			for i := 2; i < len(parts); i++ {
+				if parts[i] == "-c" && i+2 < len(parts) {
+					counter = fmt.Sprintf("[%s:%s]", parts[i+1], parts[i+2])
+					i += 2
+					continue
+				}
+				spec = append(spec, parts[i])
+			}
+			if counter != "" {
+				counters[chain+" "+ruleKey(spec)] = counter
+			}
+		}
+	}
+	return counters, nil
+}
+
+/*
+ * ruleKey 与iptables输出的顺序和地址格式无关的规则标识
+ * 地址统一格式后按参数排序,iptables输出中省略的任意地址同样忽略
+ */
+func ruleKey(spec []string) string {
+	tokens := make([]string, 0, len(spec))
+	for i := 0; i < len(spec); i++ {
+		if (spec[i] == "-s" || spec[i] == "-d") && i+1 < len(spec) {
+			addr := global.CanonicalAddr(spec[i+1])
+			i++
+			if addr == "0.0.0.0/0" || addr == "::/0" {
+				continue
+			}
+			tokens = append(tokens, spec[i-1], addr)
+			continue
+		}
+		// iptables输出的注释带引号
+		tokens = append(tokens, strings.Trim(spec[i], "\""))
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, " ")
+}
+
+func runRestore(ipt *iptables.IPTables, script string) error {
+	command := "iptables-restore"
+	if ipt.Proto() == iptables.ProtocolIPv6 {
+		command = "ip6tables-restore"
+	}
+	cmd := exec.Command(command, "--noflush", "--counters")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s失败:%v:%s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
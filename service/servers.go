@@ -2,11 +2,11 @@ package service
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net"
 	"outputGuard/global"
 	. "outputGuard/logger"
+	"outputGuard/model/orm"
 	"strings"
 	"sync"
 	"time"
@@ -27,16 +27,20 @@ type DNSResolver struct {
 }
 
 func (ss *ServerService) ServerAction(ip string) (ServerService, error) {
-	result, err := ss.GetIPv4Addresses(ip)
+	result, err := ss.GetIPAddresses(ip)
 	if err != nil {
 		return ServerService{}, err
 	}
 	return result, nil
 }
 
-func (ss *ServerService) GetIPv4Addresses(input string) (ServerService, error) {
+// GetIPAddresses 支持IPv4/IPv6地址、网段与域名,域名同时解析A与AAAA记录
+func (ss *ServerService) GetIPAddresses(input string) (ServerService, error) {
 	var ssr ServerService
 	if strings.Contains(input, "/") {
+		if _, _, err := net.ParseCIDR(input); err != nil {
+			return ssr, fmt.Errorf("invalid CIDR: %s", input)
+		}
 		ssr.Type = "IP"
 		ssr.IP = []string{input}
 		ssr.IsDoamin = false
@@ -46,24 +50,20 @@ func (ss *ServerService) GetIPv4Addresses(input string) (ServerService, error) {
 
 	ip := net.ParseIP(input)
 	if ip != nil {
-
-		if ip.To4() != nil {
-			ssr.Type = "IP"
-			ssr.IP = []string{ip.String()}
-			ssr.IsDoamin = false
-			ssr.Name = input
-			return ssr, nil
-		}
-		return ssr, fmt.Errorf("invalid IPv4 address: %s", input)
+		ssr.Type = "IP"
+		ssr.IP = []string{ip.String()}
+		ssr.IsDoamin = false
+		ssr.Name = input
+		return ssr, nil
 	}
 
-	ipv4Addresses, err := ss.getIPv4AddressesForDomain(input)
+	addresses, err := ss.getIPAddressesForDomain(input)
 	if err != nil {
 		return ssr, err
 	}
 
 	ssr.Type = "Domain"
-	ssr.IP = ipv4Addresses
+	ssr.IP = addresses
 	ssr.IsDoamin = true
 	ssr.Name = input
 	return ssr, nil
@@ -97,31 +97,29 @@ func (ss *ServerService) BuildDNSResolver() {
 	}
 }
 
-func (ss *ServerService) getIPv4AddressesForDomain(domain string) ([]string, error) {
+func (ss *ServerService) getIPAddressesForDomain(domain string) ([]string, error) {
 	ss.BuildDNSResolver()
 	ipbj, err1 := ss.DNSResolvers.Resolver.LookupIP(context.Background(), "ip", domain)
 	if err1 != nil {
 		return nil, fmt.Errorf("dns解析失败: %v", err1)
 	}
 
-	ipv4AddressesMap := make(map[string]struct{})
+	addressesMap := make(map[string]struct{})
 
 	for _, ip := range ipbj {
-		if ip.To4() != nil {
-			ipv4AddressesMap[ip.String()] = struct{}{}
-		}
+		addressesMap[ip.String()] = struct{}{}
 	}
 
-	ipv4Addresses := make([]string, 0, len(ipv4AddressesMap))
-	for ip := range ipv4AddressesMap {
-		ipv4Addresses = append(ipv4Addresses, ip)
+	addresses := make([]string, 0, len(addressesMap))
+	for ip := range addressesMap {
+		addresses = append(addresses, ip)
 	}
 
-	if len(ipv4Addresses) == 0 {
-		return nil, fmt.Errorf("no IPv4 addresses found for the domain")
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("no IP addresses found for the domain")
 	}
 
-	return ipv4Addresses, nil
+	return addresses, nil
 }
 
 /*
@@ -131,98 +129,71 @@ func (ss *ServerService) getIPv4AddressesForDomain(domain string) ([]string, err
 func (ss *ServerService) LookupDomainIP(wssServer *WssServer) {
 	for {
 		time.Sleep(5 * time.Minute)
-		domian, err := wssServer.Orms.QueryUniqueDomainNames()
-		Logger.Info(fmt.Sprintf("查询到的域名为:%s", domian))
+		entries, err := wssServer.Orms.ListDomainEntries()
 		if err != nil {
 			Logger.Error(fmt.Sprintf("查询域名失败: %s", err.Error()))
-			return
+			continue
 		}
-		sem := make(chan struct{}, len(domian))
+		sem := make(chan struct{}, 10)
 		wg := sync.WaitGroup{}
 
-		for _, domain := range domian {
+		for i := range entries {
 			sem <- struct{}{}
 			wg.Add(1)
-			go func(domain string, wssServer *WssServer) {
+			go func(entry *orm.Entry, wssServer *WssServer) {
 				defer func() {
 					<-sem
 					wg.Done()
 				}()
-				result, err := ss.GetIPv4Addresses(domain)
+				domain := entry.Name
+				result, err := ss.GetIPAddresses(domain)
 				if err != nil {
 					Logger.Error(fmt.Sprintf("查询域名 %s 失败: %s", domain, err.Error()))
 					return
 				}
+				known := make(map[string]bool, len(entry.IPs))
+				for _, row := range entry.IPs {
+					known[row.IP] = true
+				}
+				newIPs := make([]string, 0)
 				for _, ip := range result.IP {
-
-					isExits, err := wssServer.Orms.Query(ip)
-					if err != nil {
-						Logger.Error(fmt.Sprintf("查询IP %s 是否存在失败!: %s", ip, err.Error()))
-						continue
-					}
-					if isExits {
+					if known[ip] {
 						Logger.Info(fmt.Sprintf("域名:%s解析到的ip:%s已存在,不再重复添加", domain, ip))
 						continue
 					}
-					isLocal, err := isPrivateIP(ip)
-					if err != nil {
-						Logger.Error(fmt.Sprintf("isPrivateIP:解析%s失败:%s", ip, err.Error()))
-					}
-					var messageStruct global.Messages
-					messageStruct.Action = "add"
-					messageStruct.IP = ip
-					messageStruct.IsLocalNet = isLocal
-					messageJson, err := json.Marshal(messageStruct)
-					if err != nil {
-						Logger.Error(fmt.Sprintf("Error marshaling message: %s", err.Error()))
+					newIPs = append(newIPs, ip)
+				}
+				if len(newIPs) == 0 {
+					return
+				}
+				before := snapshotEntry(entry)
+				results := wssServer.addEntryIPs(entry, newIPs)
+				wssServer.auditWithReload(SystemOperator("dns-resolver"), AuditAutoAdd, entry, results, before)
+				for _, res := range results {
+					if res.Status == IPStatusFailed {
+						Logger.Error(fmt.Sprintf("添加IP %s 失败: %s", res.IP, res.Error))
 						continue
 					}
-					wssServer.broadcast <- []byte(messageJson)
-					go func(ip, Type, Name string, isLocal bool) {
-						if err := wssServer.Orms.Add(Type, ip, Name, time.Now().Local(), isLocal, isLocal); err != nil {
-							Logger.Error(fmt.Sprintf("添加IP %s 失败: %s", ip, err.Error()))
-						}
-					}(ip, result.Type, result.Name, isLocal)
-					Logger.Info(fmt.Sprintf("域名:%s解析到的ip:%s添加成功", domain, ip))
+					Logger.Info(fmt.Sprintf("域名:%s解析到的ip:%s添加成功", domain, res.IP))
 				}
 
-			}(domain, wssServer)
+			}(&entries[i], wssServer)
 		}
 		wg.Wait()
 
 	}
 }
 
+// isPrivateIP 内网网段由global.SetInternalNetworks配置
 func isPrivateIP(ipAddr string) (bool, error) {
-	if strings.Contains(ipAddr, "/") {
-		ipAddr = strings.Split(ipAddr, "/")[0]
-	}
-	ip := net.ParseIP(ipAddr)
-	if ip == nil {
-		return false, fmt.Errorf("无效的IP地址")
-	}
+	return global.IsInternalIP(ipAddr)
+}
 
-	// 私有IP地址范围
-	privateIPBlocks := []*net.IPNet{
-		//100.64.0.0/10
-		&net.IPNet{IP: net.ParseIP("100.64.0.0"), Mask: net.CIDRMask(10, 32)},
-		// 127.0.0.1 – 127.255.255.255
-		&net.IPNet{IP: net.ParseIP("127.0.0.0"), Mask: net.CIDRMask(8, 32)},
-		// 10.0.0.0 – 10.255.255.255
-		&net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)},
-		// 172.16.0.0 – 172.31.255.255
-		&net.IPNet{IP: net.ParseIP("172.16.0.0"), Mask: net.CIDRMask(12, 32)},
-		// 192.168.0.0 – 192.168.255.255
-		&net.IPNet{IP: net.ParseIP("192.168.0.0"), Mask: net.CIDRMask(16, 32)},
-		//169.254.0.0/16
-		&net.IPNet{IP: net.ParseIP("169.254.0.0"), Mask: net.CIDRMask(16, 32)},
+// isIPv6 支持地址与网段
+func isIPv6(addr string) bool {
+	if strings.Contains(addr, "/") {
+		addr = strings.Split(addr, "/")[0]
 	}
-
-	for _, block := range privateIPBlocks {
-		if block.Contains(ip) {
-			return true, nil
-		}
-	}
-
-	return false, nil
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil
 }
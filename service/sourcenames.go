@@ -0,0 +1,77 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+ * SourceNames 源地址 -> 名字,用于按源地址统计的流量
+ * 配置文件为yaml列表,cidr可以是网段或单个ip,多个网段匹配时取最长前缀:
+ *   - cidr: 10.1.0.0/16
+ *     name: k8s-pods
+ *   - cidr: 10.2.3.4
+ *     name: build-1
+ */
+type SourceNames struct {
+	entries []sourceName
+}
+
+type sourceName struct {
+	CIDR  string `yaml:"cidr"`
+	Name  string `yaml:"name"`
+	ipnet *net.IPNet
+}
+
+// LoadSourceNames path为空时返回空的映射
+func LoadSourceNames(path string) (*SourceNames, error) {
+	names := &SourceNames{}
+	if path == "" {
+		return names, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("无法读取源地址名字文件: %v", err)
+	}
+	if err := yaml.Unmarshal(data, &names.entries); err != nil {
+		return nil, fmt.Errorf("解析源地址名字文件失败: %v", err)
+	}
+	for i := range names.entries {
+		e := &names.entries[i]
+		if _, ipnet, err := net.ParseCIDR(e.CIDR); err == nil {
+			e.ipnet = ipnet
+			continue
+		}
+		ip := net.ParseIP(e.CIDR)
+		if ip == nil {
+			return nil, fmt.Errorf("源地址名字文件中的%s不是合法的ip或网段", e.CIDR)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		e.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	return names, nil
+}
+
+// Name 没有匹配的网段时返回空字符串
+func (sn *SourceNames) Name(source string) string {
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return ""
+	}
+	name, longest := "", -1
+	for _, e := range sn.entries {
+		if !e.ipnet.Contains(ip) {
+			continue
+		}
+		if ones, _ := e.ipnet.Mask.Size(); ones > longest {
+			name, longest = e.Name, ones
+		}
+	}
+	return name
+}
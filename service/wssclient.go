@@ -1,33 +1,74 @@
 package service
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"outputGuard/global"
 	. "outputGuard/logger"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	ruleCountInterval = 30 * time.Second
+	// 等待快照期间重复请求resync的间隔,请求或快照丢失时不会一直等待
+	resyncInterval = 5 * time.Second
+)
+
 type WebSocketClient struct {
+	// 接收协程重连时替换conn,发送协程通过currentConn读取
+	connMu        sync.Mutex
 	conn          *websocket.Conn
 	done          chan struct{}
+	resync        chan uint64
 	WssServerAddr string
+	Token         string
+	// 不为空时使用wss连接server
+	TLS *tls.Config
+	// 心跳上报的规则数,由gateway设置
+	RuleCounter func() (int, error)
+	// 最后一次统计的规则数,统计在单独的协程中进行,不阻塞发送
+	rules atomic.Int64
+	// 最后收到的revision,等待快照期间丢弃增量消息,由接收协程修改,发送协程读取后重复请求resync
+	received      atomic.Uint64
+	awaitSnapshot atomic.Bool
+	applied       *revisionTracker
 }
 
 func NewWebSocketClient() *WebSocketClient {
-	return &WebSocketClient{
-		conn: nil,
-		done: make(chan struct{}),
+	wc := &WebSocketClient{
+		conn:    nil,
+		done:    make(chan struct{}),
+		resync:  make(chan uint64, 1),
+		applied: newRevisionTracker(),
 	}
+	wc.awaitSnapshot.Store(true)
+	return wc
+}
+
+func (wc *WebSocketClient) currentConn() *websocket.Conn {
+	wc.connMu.Lock()
+	defer wc.connMu.Unlock()
+	return wc.conn
 }
 
 func (wc *WebSocketClient) Connect() error {
 	hostname, _ := os.Hostname()
-	u := url.URL{Scheme: "ws", Host: wc.WssServerAddr, Path: "/ws", RawQuery: "hostname=" + hostname}
+	query := url.Values{"hostname": {hostname}, "version": {global.Version}}
+	scheme := "ws"
+	dialer := *websocket.DefaultDialer
+	if wc.TLS != nil {
+		scheme = "wss"
+		dialer.TLSClientConfig = wc.TLS
+	}
+	u := url.URL{Scheme: scheme, Host: wc.WssServerAddr, Path: "/ws", RawQuery: query.Encode()}
 	Logger.Info(fmt.Sprintf("开始连接wss server %s\n", u.String()))
 
 	for {
@@ -36,9 +77,18 @@ func (wc *WebSocketClient) Connect() error {
 			Logger.Error("连接wss server失败,尝试重新连接")
 			return nil
 		default:
-			conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+			header := http.Header{}
+			if wc.Token != "" {
+				header.Set("Authorization", "Bearer "+wc.Token)
+			}
+			conn, _, err := dialer.Dial(u.String(), header)
 			if err == nil {
+				wc.connMu.Lock()
+				if wc.conn != nil {
+					wc.conn.Close()
+				}
 				wc.conn = conn
+				wc.connMu.Unlock()
 				Logger.Info("连接wss server成功")
 				return nil
 			}
@@ -56,27 +106,33 @@ func (wc *WebSocketClient) StartReceiver() {
 			case <-wc.done:
 				return
 			default:
-				_, message, err := wc.conn.ReadMessage()
+				_, message, err := wc.currentConn().ReadMessage()
 				if err != nil {
-
 					if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 						Logger.Error(fmt.Sprintf("连接关闭：%s", err.Error()))
 					} else {
 						Logger.Error(fmt.Sprintf("读取数据失败：%s", err.Error()))
-						wc.Connect()
 					}
-
+					// 重连只在接收协程中进行,重新注册后server会下发快照
+					wc.awaitSnapshot.Store(true)
+					wc.Connect()
+					continue
 				}
 
-				var mgs global.Messages
-				err = json.Unmarshal(message, &mgs)
-				if mgs.IP == "" {
-					Logger.Info(fmt.Sprintf("client接收ip为空的数据: %s", string(message)))
+				var envelope global.Envelope
+				if err := json.Unmarshal(message, &envelope); err != nil || envelope.Message == nil {
+					Logger.Error(fmt.Sprintf("解析数据失败,原始字符串：%s", string(message)))
 					continue
 				}
 				Logger.Info(fmt.Sprintf("client接收到数据: %s", string(message)))
-				if err != nil {
-					Logger.Error(fmt.Sprintf("解析数据失败：%s,原始字符串：%s", err.Error(), string(message)))
+				mgs := *envelope.Message
+				mgs.Revision = envelope.Revision
+				if !wc.accept(mgs) {
+					continue
+				}
+				if mgs.IP == "" && mgs.Action != global.ActionSnapshot {
+					Logger.Info(fmt.Sprintf("client接收ip为空的数据: %s", string(message)))
+					global.ClientCacher.AckChan <- global.Ack{Revision: mgs.Revision}
 					continue
 				}
 				global.ClientCacher.IpChan <- mgs
@@ -85,26 +141,161 @@ func (wc *WebSocketClient) StartReceiver() {
 	}()
 }
 
+/*
+ * 检查revision是否连续
+ * 快照总是接受;增量消息重复时丢弃,不连续时丢弃并请求resync直到收到快照
+ */
+func (wc *WebSocketClient) accept(mgs global.Messages) bool {
+	received := wc.received.Load()
+	if mgs.Action == global.ActionSnapshot {
+		wc.received.Store(mgs.Revision)
+		wc.awaitSnapshot.Store(false)
+		return true
+	}
+	if wc.awaitSnapshot.Load() || mgs.Revision <= received {
+		Logger.Info(fmt.Sprintf("丢弃revision %d,当前revision:%d", mgs.Revision, received))
+		return false
+	}
+	if mgs.Revision != received+1 {
+		Logger.Warn(fmt.Sprintf("revision不连续,期望%d,收到%d,请求resync", received+1, mgs.Revision))
+		wc.awaitSnapshot.Store(true)
+		// 发送协程忙时丢弃,收到快照前由发送协程定时重新请求
+		select {
+		case wc.resync <- received:
+		default:
+		}
+		return false
+	}
+	wc.received.Store(mgs.Revision)
+	return true
+}
+
+// StartSender 所有写操作都在这里完成:心跳、ack、resync请求与被拦截的连接
 func (wc *WebSocketClient) StartSender() {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
+	if wc.RuleCounter != nil {
+		go wc.countRules()
+	}
+	// 最后一次请求resync的时间,未等待快照时随心跳更新,等待超过resyncInterval时重新请求
+	lastResync := time.Now()
 
 	for {
+		var envelope global.Envelope
 		select {
 		case <-wc.done:
 			return
-		case t := <-ticker.C:
-			err := wc.conn.WriteMessage(websocket.TextMessage, []byte(t.String()))
-			if err != nil {
-				Logger.Error(fmt.Sprintf("发送数据失败:%s", err.Error()))
+		case <-ticker.C:
+			if !wc.awaitSnapshot.Load() {
+				lastResync = time.Now()
+			} else if time.Since(lastResync) >= resyncInterval {
+				Logger.Warn("等待快照超时,重新请求resync")
+				lastResync = time.Now()
+				envelope = global.Envelope{Type: global.EnvelopeResync, Revision: wc.received.Load(), Applied: wc.applied.Applied()}
+				break
+			}
+			envelope = global.Envelope{Type: global.EnvelopeHeartbeat, Applied: wc.applied.Applied(), Rules: int(wc.rules.Load())}
+		case ack := <-global.ClientCacher.AckChan:
+			if ack.Retrying {
+				envelope = global.Envelope{
+					Type:     global.EnvelopeFailure,
+					Revision: ack.Revision,
+					Applied:  wc.applied.Applied(),
+					Error:    ack.Error,
+					Key:      ack.Key,
+					Attempt:  ack.Attempt,
+				}
+				break
 			}
+			envelope = global.Envelope{
+				Type:       global.EnvelopeAck,
+				Revision:   ack.Revision,
+				Applied:    wc.applied.Done(ack.Revision, ack.Snapshot),
+				Error:      ack.Error,
+				Snapshot:   ack.Snapshot,
+				Key:        ack.Key,
+				Attempt:    ack.Attempt,
+				DeadLetter: ack.DeadLetter,
+			}
+		case flows := <-global.ClientCacher.BlockedChan:
+			envelope = global.Envelope{Type: global.EnvelopeBlocked, Applied: wc.applied.Applied(), Blocked: flows}
+		case received := <-wc.resync:
+			lastResync = time.Now()
+			envelope = global.Envelope{Type: global.EnvelopeResync, Revision: received, Applied: wc.applied.Applied()}
+		}
+		data, err := json.Marshal(envelope)
+		if err != nil {
+			Logger.Error(fmt.Sprintf("序列化数据失败:%s", err.Error()))
+			continue
+		}
+		if err := wc.currentConn().WriteMessage(websocket.TextMessage, data); err != nil {
+			Logger.Error(fmt.Sprintf("发送数据失败:%s", err.Error()))
+		}
+	}
+}
+
+// countRules 统计规则需要列出全部规则,规则多时耗时较长,不必每秒执行
+func (wc *WebSocketClient) countRules() {
+	ticker := time.NewTicker(ruleCountInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := wc.RuleCounter(); err != nil {
+			Logger.Error(fmt.Sprintf("统计规则数失败:%s", err.Error()))
+		} else {
+			wc.rules.Store(int64(n))
+		}
+		select {
+		case <-wc.done:
+			return
+		case <-ticker.C:
 		}
 	}
 }
 
 func (wc *WebSocketClient) Close() {
 	close(wc.done)
-	if wc.conn != nil {
-		wc.conn.Close()
+	if conn := wc.currentConn(); conn != nil {
+		conn.Close()
+	}
+}
+
+/*
+ * 记录已连续应用到的revision
+ * 消息并发应用,完成顺序可能与revision不同,先完成的记录在done中
+ */
+type revisionTracker struct {
+	mu      sync.Mutex
+	applied uint64
+	done    map[uint64]bool
+}
+
+func newRevisionTracker() *revisionTracker {
+	return &revisionTracker{done: make(map[uint64]bool)}
+}
+
+func (rt *revisionTracker) Applied() uint64 {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.applied
+}
+
+// Done 快照应用完成后直接推进到快照的revision
+func (rt *revisionTracker) Done(revision uint64, snapshot bool) uint64 {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if snapshot {
+		rt.applied = revision
+		for r := range rt.done {
+			if r <= revision {
+				delete(rt.done, r)
+			}
+		}
+	} else if revision > rt.applied {
+		rt.done[revision] = true
+	}
+	for rt.done[rt.applied+1] {
+		delete(rt.done, rt.applied+1)
+		rt.applied++
 	}
+	return rt.applied
 }
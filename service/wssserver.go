@@ -13,10 +13,19 @@ import (
 )
 
 type Client struct {
-	conn     *websocket.Conn
-	send     chan []byte
-	hostname string
-	server   *WssServer
+	conn        *websocket.Conn
+	send        chan []byte
+	resync      chan struct{}
+	hostname    string
+	remoteAddr  string
+	version     string
+	connectedAt time.Time
+	server      *WssServer
+	// 以下字段由server.mutex保护
+	applied  uint64
+	lastSeen time.Time
+	rules    int
+	errors   []ApplyError
 }
 
 type WssServer struct {
@@ -26,6 +35,11 @@ type WssServer struct {
 	unregister chan *Client
 	broadcast  chan []byte
 	mutex      sync.Mutex
+	// 分配revision与写入broadcast在同一把锁内,保证broadcast中的消息按revision排序
+	publishMu sync.Mutex
+	revision  uint64
+	// gateway上报的被拦截连接
+	blocked *blockedStore
 }
 
 func NewServer() *WssServer {
@@ -34,6 +48,7 @@ func NewServer() *WssServer {
 		register:   make(chan *Client, 10000),
 		unregister: make(chan *Client, 10000),
 		broadcast:  make(chan []byte, 10000),
+		blocked:    newBlockedStore(),
 	}
 }
 
@@ -66,7 +81,9 @@ func (s *WssServer) Run() {
 func (s *WssServer) registerClient(client *Client) {
 	s.mutex.Lock()
 	s.clients[client] = true
-	go s.sendMessageToFirstRegisterClient(client)
+	client.lastSeen = time.Now()
+	// 注册后先下发全量快照
+	client.requestResync()
 	Logger.Info(fmt.Sprintf("客户端:%s注册成功,当前客户端数:%d", client.hostname, len(s.clients)))
 	s.mutex.Unlock()
 }
@@ -82,77 +99,130 @@ func (s *WssServer) unregisterClient(client *Client) {
 	s.mutex.Unlock()
 }
 
+/*
+ * 按revision顺序写入每个客户端的发送队列
+ * 队列已满时丢弃该消息并安排重新下发快照,gateway也会因revision不连续主动请求resync
+ */
 func (s *WssServer) broadcastMessage(message []byte) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	for client := range s.clients {
+		select {
+		case client.send <- message:
+		default:
+			Logger.Error(fmt.Sprintf("客户端:%s发送队列已满,丢弃消息并重新下发快照", client.hostname))
+			client.requestResync()
+		}
+	}
+}
 
-		go func(c *Client) {
-			select {
-			case c.send <- message:
-				return
-			default:
-
-				Logger.Info(fmt.Sprintf("发送消息给客户端:%s失败", c.hostname))
-				//失败重试
-				s.retryFailedMessage(c, message)
-			}
-		}(client)
+// Publish 分配revision后把消息发布给所有已注册的gateway
+func (s *WssServer) Publish(message global.Messages) error {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	envelope := global.Envelope{Type: global.EnvelopeMessage, Revision: s.revision + 1, Message: &message}
+	messageJson, err := json.Marshal(envelope)
+	if err != nil {
+		return err
 	}
+	s.revision++
+	Logger.Info(fmt.Sprintf("即将发布的%s任务:%s", message.Action, string(messageJson)))
+	s.broadcast <- messageJson
+	return nil
 }
 
-func (s *WssServer) sendMessageToFirstRegisterClient(client *Client) {
+func (s *WssServer) currentRevision() uint64 {
+	s.publishMu.Lock()
+	defer s.publishMu.Unlock()
+	return s.revision
+}
+
+/*
+ * 全量快照
+ * 先取revision再查询数据库,快照至少包含该revision之前的所有变更
+ * 之后收到的增量消息重复应用是幂等的
+ * 同一条规则被多个条目引用时合并所有条目
+ */
+func (s *WssServer) buildSnapshot() ([]byte, int, error) {
+	revision := s.currentRevision()
+	snapshot := global.Messages{Action: global.ActionSnapshot, Items: make([]global.Messages, 0)}
 	ips, err := s.Orms.QueryAll()
 	if err != nil {
-		Logger.Error(fmt.Sprintf("查询IP失败: %s", err.Error()))
+		return nil, 0, err
+	}
+	entries, err := s.Orms.ListEntryRefs()
+	if err != nil {
+		return nil, 0, err
+	}
+	refs := make(map[uint]global.EntryRef, len(entries))
+	for i := range entries {
+		refs[entries[i].ID] = entryRef(&entries[i])
 	}
+	seen := make(map[string]int, len(ips))
 	for _, ip := range ips {
-		messageStruct := global.Messages{
+		message := global.Messages{
 			IP:         ip.IP,
-			Action:     "add",
+			Action:     global.ActionAdd,
 			IsLocalNet: ip.IsLocalNet,
+			Protocol:   ip.Protocol,
+			Ports:      ip.Ports,
+			Sources:    ip.Sources,
 		}
-		messageJson, err := json.Marshal(messageStruct)
-		if err != nil {
-			Logger.Error(fmt.Sprintf("Error marshaling message: %s", err.Error()))
+		if ref, ok := refs[ip.EntryID]; ok {
+			message.Entries = []global.EntryRef{ref}
+		}
+		if i, ok := seen[message.Key()]; ok {
+			snapshot.Items[i].Entries = global.MergeEntries(snapshot.Items[i].Entries, message.Entries)
 			continue
 		}
-		message := []byte(messageJson)
-
-		go func(client *Client, message []byte) {
-			s.mutex.Lock()
-			defer s.mutex.Unlock()
-			select {
-			case client.send <- message:
-				return
-			default:
-				s.retryFailedMessage(client, message)
-			}
-
-		}(client, message)
-
+		seen[message.Key()] = len(snapshot.Items)
+		snapshot.Items = append(snapshot.Items, message)
 	}
+	messageJson, err := json.Marshal(global.Envelope{Type: global.EnvelopeMessage, Revision: revision, Message: &snapshot})
+	if err != nil {
+		return nil, 0, err
+	}
+	return messageJson, len(snapshot.Items), nil
 }
 
-func (s *WssServer) retryFailedMessage(c *Client, message []byte) {
-	Logger.Info(fmt.Sprintf("重试发送消息给客户端:%s", c.hostname))
-	time.Sleep(500 * time.Millisecond)
-	maxRetries := 5 // 最大重试次数
-	retryCount := 0
+// requestResync 合并多次请求,由WritePump下发快照
+func (c *Client) requestResync() {
+	select {
+	case c.resync <- struct{}{}:
+	default:
+	}
+}
 
-	for retryCount < maxRetries {
-		select {
-		case c.send <- message:
-			Logger.Info(fmt.Sprintf("重试消息发送给客户端:%s 成功", c.hostname))
-			return
-		default:
-			time.Sleep(500 * time.Millisecond)
-			retryCount++
+func (s *WssServer) handleEnvelope(c *Client, envelope global.Envelope) {
+	s.mutex.Lock()
+	c.lastSeen = time.Now()
+	switch envelope.Type {
+	case global.EnvelopeAck:
+		if envelope.Applied > c.applied {
+			c.applied = envelope.Applied
 		}
+		c.recordAck(envelope)
+	case global.EnvelopeFailure:
+		c.recordAck(envelope)
+	case global.EnvelopeHeartbeat:
+		c.rules = envelope.Rules
 	}
+	s.mutex.Unlock()
 
-	Logger.Error(fmt.Sprintf("消息发送给客户端:%s 失败，已达到最大%d次数", c.hostname, maxRetries))
+	switch envelope.Type {
+	case global.EnvelopeAck:
+		if envelope.Error != "" {
+			Logger.Error(fmt.Sprintf("客户端:%s应用revision %d失败:%s", c.hostname, envelope.Revision, envelope.Error))
+		}
+	case global.EnvelopeFailure:
+		Logger.Warn(fmt.Sprintf("客户端:%s应用%s(revision %d)第%d次失败,等待重试:%s", c.hostname, envelope.Key, envelope.Revision, envelope.Attempt, envelope.Error))
+	case global.EnvelopeBlocked:
+		s.blocked.record(c.hostname, envelope.Blocked)
+	case global.EnvelopeResync:
+		Logger.Warn(fmt.Sprintf("客户端:%s请求resync,已应用revision:%d", c.hostname, envelope.Applied))
+		c.requestResync()
+	}
 }
 
 func (c *Client) WritePump() {
@@ -163,6 +233,16 @@ func (c *Client) WritePump() {
 				return
 			}
 			c.conn.WriteMessage(websocket.TextMessage, message)
+		case <-c.resync:
+			snapshot, count, err := c.server.buildSnapshot()
+			if err != nil {
+				// gateway等待快照期间丢弃增量消息,关闭连接让gateway重连后重新下发
+				Logger.Error(fmt.Sprintf("查询IP失败,关闭客户端:%s的连接: %s", c.hostname, err.Error()))
+				c.conn.Close()
+				return
+			}
+			Logger.Info(fmt.Sprintf("下发快照给客户端:%s,规则数:%d", c.hostname, count))
+			c.conn.WriteMessage(websocket.TextMessage, snapshot)
 		}
 	}
 }
@@ -173,10 +253,15 @@ func (c *Client) ReadPump() {
 	}()
 
 	for {
-		_, _, err := c.conn.ReadMessage()
+		_, message, err := c.conn.ReadMessage()
 		if err != nil {
-			c.server.unregister <- c
 			return
 		}
+		var envelope global.Envelope
+		if err := json.Unmarshal(message, &envelope); err != nil {
+			// 旧版本gateway的心跳为时间字符串
+			envelope = global.Envelope{Type: global.EnvelopeHeartbeat}
+		}
+		c.server.handleEnvelope(c, envelope)
 	}
 }